@@ -0,0 +1,270 @@
+package tunnel
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nknorg/nkn-sdk-go"
+	ts "github.com/nknorg/nkn-tuna-session"
+)
+
+var (
+	ErrAdminTokenRequired = errors.New("admin token is required")
+	ErrAdminNotLocal      = errors.New("admin address should be a loopback address or unix socket")
+	ErrTunnelNotFound     = errors.New("tunnel not found")
+)
+
+// TunnelStatus is the status of a tunnel returned by admin API.
+type TunnelStatus struct {
+	State        State        `json:"state"`
+	Error        string       `json:"error,omitempty"`
+	From         string       `json:"from"`
+	To           string       `json:"to"`
+	Addr         string       `json:"addr"`
+	AcceptAddrs  []string     `json:"acceptAddrs"`
+	TunaPubAddrs *ts.PubAddrs `json:"tunaPubAddrs,omitempty"`
+	Stats        *Stats       `json:"stats"`
+	Conns        []*ConnInfo  `json:"conns"`
+	Mappings     []*Mapping   `json:"mappings"`
+}
+
+// Status returns the status of the tunnel.
+func (t *Tunnel) Status() *TunnelStatus {
+	s := &TunnelStatus{
+		State:        t.State(),
+		Error:        errString(t.Err()),
+		From:         t.FromAddr(),
+		To:           t.ToAddr(),
+		Addr:         t.Addr().String(),
+		TunaPubAddrs: t.TunaPubAddrs(),
+		Stats:        t.Stats(),
+		Conns:        t.Conns(),
+		Mappings:     t.Mappings(),
+		AcceptAddrs:  t.AcceptAddrs(),
+	}
+	return s
+}
+
+// AdminServer serves a local HTTP API to inspect and control tunnels. Every
+// request should have header "Authorization: Bearer <token>".
+//
+//	GET  /status            status of all tunnels
+//	POST /accept-addrs      {"tunnel": 0, "addrs": ["regex"]}, empty addrs accepts any address
+//	POST /conns/kill        {"tunnel": 0, "id": 1}
+//	POST /mappings/add      {"tunnel": 0, "from": "127.0.0.1:8080", "to": "nkn-address"}
+//	POST /mappings/remove   {"tunnel": 0, "from": "127.0.0.1:8080"}
+type AdminServer struct {
+	tunnels    []*Tunnel
+	token      string
+	listener   net.Listener
+	addr       net.Addr
+	socketPath string
+	server     *http.Server
+}
+
+type adminRequest struct {
+	Tunnel int      `json:"tunnel"`
+	Addrs  []string `json:"addrs"`
+	ID     uint64   `json:"id"`
+	From   string   `json:"from"`
+	To     string   `json:"to"`
+}
+
+// NewAdminServer listens at addr, which should be a loopback tcp address like
+// "127.0.0.1:9000" or a unix socket like "unix:/run/nkn-tunnel.sock".
+func NewAdminServer(addr, token string, tunnels []*Tunnel) (*AdminServer, error) {
+	if len(token) == 0 {
+		return nil, ErrAdminTokenRequired
+	}
+
+	e, err := ParseEndpoint(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch e.Scheme {
+	case SchemeTCP:
+		host, _, err := net.SplitHostPort(e.Address)
+		if err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(host)
+		if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return nil, ErrAdminNotLocal
+		}
+	case SchemeUnix:
+	default:
+		return nil, ErrAdminNotLocal
+	}
+	if e.TLS || e.HasPortRange() {
+		return nil, fmt.Errorf("%w %s: options are not supported for admin address", ErrInvalidEndpoint, addr)
+	}
+
+	s := &AdminServer{
+		tunnels: tunnels,
+		token:   token,
+	}
+	if e.Scheme == SchemeUnix && !strings.HasPrefix(e.Address, "@") {
+		s.listener, err = listenUnixPrivate(e.Address)
+		s.addr = &net.UnixAddr{Name: e.Address, Net: "unix"}
+		s.socketPath = e.Address
+	} else {
+		s.listener, err = net.Listen(e.network(), e.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/accept-addrs", s.handlePost(s.setAcceptAddrs))
+	mux.HandleFunc("/conns/kill", s.handlePost(s.killConn))
+	mux.HandleFunc("/mappings/add", s.handlePost(s.addMapping))
+	mux.HandleFunc("/mappings/remove", s.handlePost(s.removeMapping))
+	s.server = &http.Server{Handler: s.auth(mux)}
+
+	return s, nil
+}
+
+// listenUnixPrivate listens at unix socket path that is only accessible by
+// owner. The socket is created in a private directory and restricted before
+// being linked to path, so that others can never connect to it.
+func listenUnixPrivate(path string) (*net.UnixListener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".nkn-tunnel-admin-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "admin.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false)
+	err = os.Chmod(tmp, 0600)
+	if err == nil {
+		// Unlike rename, link fails instead of replacing an existing socket.
+		err = os.Link(tmp, path)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Addr returns the listening address of admin server.
+func (s *AdminServer) Addr() net.Addr {
+	if s.addr != nil {
+		return s.addr
+	}
+	return s.listener.Addr()
+}
+
+// Serve serves admin API until admin server is closed.
+func (s *AdminServer) Serve() error {
+	err := s.server.Serve(s.listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Close closes admin server.
+func (s *AdminServer) Close() error {
+	err := s.server.Close()
+	if len(s.socketPath) > 0 {
+		os.Remove(s.socketPath)
+	}
+	return err
+}
+
+func (s *AdminServer) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			writeAdminError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *AdminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	tunnels := make([]*TunnelStatus, 0, len(s.tunnels))
+	for _, t := range s.tunnels {
+		tunnels = append(tunnels, t.Status())
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"tunnels": tunnels})
+}
+
+func (s *AdminServer) handlePost(handle func(*Tunnel, *adminRequest) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeAdminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+
+		req := &adminRequest{}
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(req)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Tunnel < 0 || req.Tunnel >= len(s.tunnels) {
+			writeAdminError(w, http.StatusNotFound, ErrTunnelNotFound)
+			return
+		}
+
+		err = handle(s.tunnels[req.Tunnel], req)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrConnNotFound) || errors.Is(err, ErrMappingNotFound) {
+				status = http.StatusNotFound
+			}
+			writeAdminError(w, status, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+	}
+}
+
+func (s *AdminServer) setAcceptAddrs(t *Tunnel, req *adminRequest) error {
+	if len(req.Addrs) == 0 {
+		return t.SetAcceptAddrs(nil)
+	}
+	return t.SetAcceptAddrs(nkn.NewStringArray(req.Addrs...))
+}
+
+func (s *AdminServer) killConn(t *Tunnel, req *adminRequest) error {
+	return t.KillConn(req.ID)
+}
+
+func (s *AdminServer) addMapping(t *Tunnel, req *adminRequest) error {
+	return t.AddMapping(req.From, req.To)
+}
+
+func (s *AdminServer) removeMapping(t *Tunnel, req *adminRequest) error {
+	return t.RemoveMapping(req.From)
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+	tunnel "github.com/nknorg/nkn-tunnel"
+)
+
+// Bench protocol runs over a tunneled TCP connection. Each request is a one
+// byte command followed by a uint64 in big endian:
+//   - ping: responder echoes the request.
+//   - upload: client sends n bytes, responder replies n after receiving all.
+//   - download: responder sends n bytes.
+const (
+	benchCmdPing     = 'p'
+	benchCmdUpload   = 'u'
+	benchCmdDownload = 'd'
+	benchBufSize     = 64 << 10
+)
+
+const (
+	benchReadyTimeout = time.Minute
+	benchModeMixed    = "mixed"
+	benchModeNone     = "none"
+)
+
+func init() {
+	subcommands["bench"] = runBench
+}
+
+type benchFlags struct {
+	*clientFlags
+	responder   *bool
+	to          *string
+	sessions    *int
+	pings       *int
+	bytes       *int
+	jsonOutput  *bool
+	handshake   *bool
+	mux         *bool
+	compression *string
+}
+
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	f := &benchFlags{
+		clientFlags: addClientFlags(fs),
+		responder:   fs.Bool("responder", false, "run as bench responder listening on nkn address"),
+		to:          fs.String("to", "", "nkn address of bench responder"),
+		sessions:    fs.Int("c", 4, "number of parallel sessions"),
+		pings:       fs.Int("pings", 20, "number of pings per session to measure rtt"),
+		bytes:       fs.Int("bytes", 4<<20, "bytes to upload and download per session"),
+		jsonOutput:  fs.Bool("json", false, "print report in json"),
+		handshake:   fs.Bool("handshake", false, "exchange handshake at the beginning of each session, should be the same on both side"),
+		mux:         fs.Bool("mux", false, "multiplex sessions over one nkn session, should be the same on both side"),
+		compression: fs.String("compression", "", `compress sessions, "deflate" or "none"`),
+	}
+	fs.Parse(args)
+
+	account, err := f.account()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	config := f.config()
+	config.Handshake = *f.handshake
+	config.Mux = *f.mux
+	config.Compression = *f.compression
+
+	if *f.responder {
+		log.Fatal(runBenchResponder(account, *f.identifier, *f.useTuna, config))
+	}
+
+	if len(*f.to) == 0 {
+		log.Fatal("To address is empty")
+	}
+
+	report, err := runBenchClient(f, account, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *f.jsonOutput {
+		b, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(b))
+	} else {
+		report.print(os.Stdout)
+	}
+}
+
+// runBenchResponder listens on NKN and tunnels sessions to a local bench
+// server.
+func runBenchResponder(account *nkn.Account, identifier string, tuna bool, config *tunnel.Config) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	t, err := tunnel.NewTunnel(account, identifier, "", listener.Addr().String(), tuna, config, nil)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+
+	log.Println("Bench responder is listening at", t.FromAddr())
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveBench(conn)
+		}
+	}()
+
+	return t.Start()
+}
+
+func serveBench(conn net.Conn) {
+	defer conn.Close()
+
+	buf := make([]byte, benchBufSize)
+	rand.Read(buf)
+
+	req := make([]byte, 9)
+	for {
+		_, err := io.ReadFull(conn, req)
+		if err != nil {
+			return
+		}
+		n := int64(binary.BigEndian.Uint64(req[1:]))
+
+		switch req[0] {
+		case benchCmdPing:
+			_, err = conn.Write(req)
+		case benchCmdUpload:
+			_, err = io.CopyN(io.Discard, conn, n)
+			if err == nil {
+				_, err = conn.Write(req)
+			}
+		case benchCmdDownload:
+			err = writeBenchData(conn, buf, n)
+		default:
+			err = fmt.Errorf("unknown bench command %d", req[0])
+		}
+		if err != nil {
+			log.Println("Bench error:", err)
+			return
+		}
+	}
+}
+
+func writeBenchData(w io.Writer, buf []byte, n int64) error {
+	for n > 0 {
+		b := buf
+		if int64(len(b)) > n {
+			b = b[:n]
+		}
+		m, err := w.Write(b)
+		if err != nil {
+			return err
+		}
+		n -= int64(m)
+	}
+	return nil
+}
+
+type benchSessionResult struct {
+	connectTime time.Duration
+	rtts        []time.Duration
+	upload      time.Duration
+	download    time.Duration
+	err         error
+}
+
+// benchStats is the percentiles of durations in milliseconds.
+type benchStats struct {
+	Min float64 `json:"min"`
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+type benchReport struct {
+	Mode             string      `json:"mode"`
+	Sessions         int         `json:"sessions"`
+	TunaSessions     uint64      `json:"tunaSessions"`
+	NKNSessions      uint64      `json:"nknSessions"`
+	Failed           int         `json:"failed"`
+	Errors           []string    `json:"errors,omitempty"`
+	ConnectTime      *benchStats `json:"connectTimeMs,omitempty"`
+	RTT              *benchStats `json:"rttMs,omitempty"`
+	BytesPerSession  int         `json:"bytesPerSession"`
+	UploadMBPerSec   float64     `json:"uploadMBPerSec"`
+	DownloadMBPerSec float64     `json:"downloadMBPerSec"`
+}
+
+func runBenchClient(f *benchFlags, account *nkn.Account, config *tunnel.Config) (*benchReport, error) {
+	t, err := tunnel.NewTunnel(account, *f.identifier, "127.0.0.1:0", *f.to, *f.useTuna, config, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Close()
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- t.Start()
+	}()
+	select {
+	case <-t.Ready():
+	case err = <-errChan:
+		return nil, fmt.Errorf("start tunnel: %w", err)
+	case <-time.After(benchReadyTimeout):
+		return nil, fmt.Errorf("tunnel is not ready in %v", benchReadyTimeout)
+	}
+	localAddr := t.ListenAddrs()[0].String()
+
+	results := make([]*benchSessionResult, *f.sessions)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = benchSession(localAddr, *f.pings, int64(*f.bytes))
+		}(i)
+	}
+	wg.Wait()
+
+	stats := t.Stats()
+	report := &benchReport{
+		Mode:            benchMode(stats),
+		Sessions:        len(results),
+		TunaSessions:    stats.TunaConns,
+		NKNSessions:     stats.NKNConns,
+		BytesPerSession: *f.bytes,
+	}
+
+	var connectTimes, rtts []time.Duration
+	for _, r := range results {
+		if r.err != nil {
+			report.Failed++
+			report.Errors = append(report.Errors, r.err.Error())
+			continue
+		}
+		connectTimes = append(connectTimes, r.connectTime)
+		rtts = append(rtts, r.rtts...)
+		report.UploadMBPerSec += mbPerSec(*f.bytes, r.upload)
+		report.DownloadMBPerSec += mbPerSec(*f.bytes, r.download)
+	}
+	report.ConnectTime = newBenchStats(connectTimes)
+	report.RTT = newBenchStats(rtts)
+
+	return report, nil
+}
+
+// benchMode returns the mode of sessions that are actually used, which may
+// be both tuna and nkn with tuna dial fallback or race.
+func benchMode(stats *tunnel.Stats) string {
+	switch {
+	case stats.TunaConns > 0 && stats.NKNConns > 0:
+		return benchModeMixed
+	case stats.TunaConns > 0:
+		return tunnel.ModeTuna
+	case stats.NKNConns > 0:
+		return tunnel.ModeNKN
+	default:
+		return benchModeNone
+	}
+}
+
+// benchSession connects to bench responder through tunnel. Connect time is
+// measured by the first ping, which includes NKN session setup.
+func benchSession(addr string, pings int, size int64) *benchSessionResult {
+	r := &benchSessionResult{}
+	start := time.Now()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	defer conn.Close()
+
+	buf := make([]byte, benchBufSize)
+	rand.Read(buf)
+	req := make([]byte, 9)
+	resp := make([]byte, 9)
+	roundTrip := func(cmd byte, n int64) error {
+		req[0] = cmd
+		binary.BigEndian.PutUint64(req[1:], uint64(n))
+		_, err := conn.Write(req)
+		if err != nil {
+			return err
+		}
+		if cmd == benchCmdUpload {
+			err = writeBenchData(conn, buf, n)
+			if err != nil {
+				return err
+			}
+		}
+		if cmd == benchCmdDownload {
+			_, err = io.CopyN(io.Discard, conn, n)
+			return err
+		}
+		_, err = io.ReadFull(conn, resp)
+		if err != nil {
+			return err
+		}
+		if resp[0] != cmd {
+			return errors.New("unexpected bench response")
+		}
+		return nil
+	}
+
+	if r.err = roundTrip(benchCmdPing, 0); r.err != nil {
+		return r
+	}
+	r.connectTime = time.Since(start)
+
+	for i := 0; i < pings; i++ {
+		start = time.Now()
+		if r.err = roundTrip(benchCmdPing, int64(i)); r.err != nil {
+			return r
+		}
+		r.rtts = append(r.rtts, time.Since(start))
+	}
+
+	start = time.Now()
+	if r.err = roundTrip(benchCmdUpload, size); r.err != nil {
+		return r
+	}
+	r.upload = time.Since(start)
+
+	start = time.Now()
+	if r.err = roundTrip(benchCmdDownload, size); r.err != nil {
+		return r
+	}
+	r.download = time.Since(start)
+
+	return r
+}
+
+func newBenchStats(durations []time.Duration) *benchStats {
+	if len(durations) == 0 {
+		return nil
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	percentile := func(p float64) float64 {
+		i := int(p * float64(len(durations)-1))
+		return float64(durations[i]) / float64(time.Millisecond)
+	}
+	return &benchStats{
+		Min: percentile(0),
+		P50: percentile(0.5),
+		P90: percentile(0.9),
+		P99: percentile(0.99),
+		Max: percentile(1),
+	}
+}
+
+func mbPerSec(bytes int, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(bytes) / (1 << 20) / d.Seconds()
+}
+
+func (r *benchReport) print(w io.Writer) {
+	fmt.Fprintf(w, "Mode: %s (tuna sessions: %d, nkn sessions: %d)\n", r.Mode, r.TunaSessions, r.NKNSessions)
+	fmt.Fprintf(w, "Sessions: %d, failed: %d\n", r.Sessions, r.Failed)
+	for _, err := range r.Errors {
+		fmt.Fprintf(w, "  %s\n", err)
+	}
+	for _, s := range []struct {
+		name  string
+		stats *benchStats
+	}{{"Connect time", r.ConnectTime}, {"RTT", r.RTT}} {
+		if s.stats == nil {
+			continue
+		}
+		fmt.Fprintf(w, "%s (ms): min %.1f, p50 %.1f, p90 %.1f, p99 %.1f, max %.1f\n", s.name, s.stats.Min, s.stats.P50, s.stats.P90, s.stats.P99, s.stats.Max)
+	}
+	fmt.Fprintf(w, "Upload: %.2f MB/s\n", r.UploadMBPerSec)
+	fmt.Fprintf(w, "Download: %.2f MB/s\n", r.DownloadMBPerSec)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/nknorg/ncp-go"
+	"github.com/nknorg/nkn-sdk-go"
+	ts "github.com/nknorg/nkn-tuna-session"
+	tunnel "github.com/nknorg/nkn-tunnel"
+	"github.com/nknorg/nkngomobile"
+	"github.com/nknorg/tuna/geo"
+)
+
+// clientFlags are the NKN and tuna client flags shared by tunnel and
+// subcommands.
+type clientFlags struct {
+	numClients                   *int
+	seedHex                      *string
+	seedFile                     *string
+	walletFile                   *string
+	passwordFile                 *string
+	newAccount                   *bool
+	identifier                   *string
+	dialTimeout                  *int
+	useTuna                      *bool
+	tunaCountry                  *string
+	tunaServiceName              *string
+	tunaSubscriptionPrefix       *string
+	tunaMaxPrice                 *string
+	tunaMinFee                   *string
+	tunaFeeRatio                 *float64
+	tunaDownloadGeoDB            *bool
+	tunaGeoDBPath                *string
+	tunaMeasureBandwidth         *bool
+	tunaMeasurementBytesDownLink *int
+	tunaDialMode                 *string
+	tunaFallbackTimeout          *int
+	tunaRaceDelay                *int
+	mtu                          *int
+	rpcAddr                      *string
+}
+
+func addClientFlags(fs *flag.FlagSet) *clientFlags {
+	return &clientFlags{
+		numClients:                   fs.Int("n", 4, "number of clients"),
+		seedHex:                      fs.String("s", "", "secret seed in hex, visible to other users, prefer -seed-file or "+seedEnv+" env"),
+		seedFile:                     fs.String("seed-file", "", "file of secret seed in hex, should not be accessible by group or others"),
+		walletFile:                   fs.String("wallet", "", "nkn wallet json file to load secret seed from"),
+		passwordFile:                 fs.String("password-file", "", "file of wallet password, prompt for password if not set"),
+		newAccount:                   fs.Bool("new-account", false, "use a new random seed if no seed is given, NKN address changes on every start"),
+		identifier:                   fs.String("i", "", "NKN address identifier"),
+		dialTimeout:                  fs.Int("t", 0, "dial timeout in milliseconds"),
+		useTuna:                      fs.Bool("tuna", false, "use tuna instead of nkn client for nkn session"),
+		tunaCountry:                  fs.String("country", "", `tuna service node allowed country code, separated by comma, e.g. "US" or "US,CN"`),
+		tunaServiceName:              fs.String("tsn", "", "tuna reverse service name"),
+		tunaSubscriptionPrefix:       fs.String("tsp", "", "tuna subscription prefix"),
+		tunaMaxPrice:                 fs.String("tuna-max-price", "0.01", "tuna max price in unit of NKN/MB"),
+		tunaMinFee:                   fs.String("tuna-min-fee", "0.00001", "tuna nanopay minimal txn fee"),
+		tunaFeeRatio:                 fs.Float64("tuna-fee-ratio", 0.1, "tuna nanopay txn fee ratio"),
+		tunaDownloadGeoDB:            fs.Bool("tuna-download-geo-db", false, "download tuna geo db to disk"),
+		tunaGeoDBPath:                fs.String("tuna-geo-db-path", ".", "path to store tuna geo db"),
+		tunaMeasureBandwidth:         fs.Bool("tuna-measure-bandwidth", false, "tuna measure bandwidth"),
+		tunaMeasurementBytesDownLink: fs.Int("tuna-measure-bandwidth-bytes", 1, "tuna measure bandwidth bytes to transmit"),
+		tunaDialMode:                 fs.String("tuna-dial-mode", "", `how to dial nkn address with tuna: "tuna" (default), "fallback" to nkn session, or "race" with nkn session`),
+		tunaFallbackTimeout:          fs.Int("tuna-fallback-timeout", 0, "milliseconds to wait for tuna session before dialing nkn session in fallback mode, 0 is for waiting until tuna fails"),
+		tunaRaceDelay:                fs.Int("tuna-race-delay", 0, "milliseconds to delay nkn session after tuna session in race mode"),
+		mtu:                          fs.Int("mtu", 0, "ncp session mtu"),
+		rpcAddr:                      fs.String("rpc", "", "Seed RPC server address, separated by comma"),
+	}
+}
+
+// config returns the tunnel config of client flags.
+func (f *clientFlags) config() *tunnel.Config {
+	var seedRPCServerAddr *nkngomobile.StringArray
+	if len(*f.rpcAddr) > 0 {
+		seedRPCServerAddr = nkn.NewStringArrayFromString(strings.ReplaceAll(*f.rpcAddr, ",", " "))
+	}
+
+	sessionConfig := &ncp.Config{
+		MTU: int32(*f.mtu),
+	}
+	clientConfig := &nkn.ClientConfig{
+		SeedRPCServerAddr: seedRPCServerAddr,
+		SessionConfig:     sessionConfig,
+	}
+	walletConfig := &nkn.WalletConfig{
+		SeedRPCServerAddr: seedRPCServerAddr,
+	}
+	dialConfig := &nkn.DialConfig{
+		DialTimeout: int32(*f.dialTimeout),
+	}
+
+	var tsConfig *ts.Config
+	if *f.useTuna {
+		countries := strings.Split(*f.tunaCountry, ",")
+		locations := make([]geo.Location, len(countries))
+		for i := range countries {
+			locations[i].CountryCode = strings.TrimSpace(countries[i])
+		}
+
+		tsConfig = &ts.Config{
+			NumTunaListeners:             *f.numClients,
+			SessionConfig:                sessionConfig,
+			TunaIPFilter:                 &geo.IPFilter{Allow: locations},
+			TunaServiceName:              *f.tunaServiceName,
+			TunaSubscriptionPrefix:       *f.tunaSubscriptionPrefix,
+			TunaMaxPrice:                 *f.tunaMaxPrice,
+			TunaMinNanoPayFee:            *f.tunaMinFee,
+			TunaNanoPayFeeRatio:          *f.tunaFeeRatio,
+			TunaDownloadGeoDB:            *f.tunaDownloadGeoDB,
+			TunaGeoDBPath:                *f.tunaGeoDBPath,
+			TunaMeasureBandwidth:         *f.tunaMeasureBandwidth,
+			TunaMeasurementBytesDownLink: int32(*f.tunaMeasurementBytesDownLink),
+		}
+	}
+
+	return &tunnel.Config{
+		NumSubClients:       *f.numClients,
+		ClientConfig:        clientConfig,
+		WalletConfig:        walletConfig,
+		DialConfig:          dialConfig,
+		TunaSessionConfig:   tsConfig,
+		TunaDialMode:        *f.tunaDialMode,
+		TunaFallbackTimeout: int32(*f.tunaFallbackTimeout),
+		TunaRaceDelay:       int32(*f.tunaRaceDelay),
+	}
+}
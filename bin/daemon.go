@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	tunnel "github.com/nknorg/nkn-tunnel"
+)
+
+// Exit codes of tunnel. Invalid flags exit with exitConfigError as flag
+// package does, so that service managers can tell a bad config from a
+// failure worth restarting.
+const (
+	exitRuntimeError = 1
+	exitConfigError  = 2
+)
+
+// notifyStatusInterval is the interval of status updates sent to service
+// manager.
+const notifyStatusInterval = 10 * time.Second
+
+var pidFile string
+
+// isConfigError returns whether err is caused by invalid flags or config.
+func isConfigError(err error) bool {
+	return errors.Is(err, tunnel.ErrInvalidConfig) ||
+		errors.Is(err, tunnel.ErrInvalidEndpoint) ||
+		errors.Is(err, tunnel.ErrAdminNotLocal) ||
+		errors.Is(err, tunnel.ErrAdminTokenRequired)
+}
+
+// fatal logs err and exits with exitConfigError if err is caused by config,
+// or exitRuntimeError otherwise.
+func fatal(err error) {
+	if isConfigError(err) {
+		configFatal(err)
+	}
+	log.Println(err)
+	removePIDFile()
+	os.Exit(exitRuntimeError)
+}
+
+// configFatal logs v and exits with exitConfigError.
+func configFatal(v ...interface{}) {
+	log.Println(v...)
+	removePIDFile()
+	os.Exit(exitConfigError)
+}
+
+// writePIDFile writes pid of the process to path, which is removed by
+// removePIDFile on exit.
+func writePIDFile(path string) error {
+	err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	pidFile = path
+	return nil
+}
+
+func removePIDFile() {
+	if len(pidFile) == 0 {
+		return
+	}
+	err := os.Remove(pidFile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("Remove pid file error:", err)
+	}
+	pidFile = ""
+}
+
+// sdNotify sends state to service manager like sd_notify of systemd, e.g.
+// "READY=1". It does nothing if NOTIFY_SOCKET env is not set.
+func sdNotify(state ...string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if len(path) == 0 {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(strings.Join(state, "\n")))
+	return err
+}
+
+func tunnelStatus(t *tunnel.Tunnel) string {
+	stats := t.Stats()
+	return fmt.Sprintf("STATUS=%s at %s, %d active connections, %d total", t.State(), t.FromAddr(), stats.ActiveConns, stats.TotalConns)
+}
+
+// notifyState logs state changes of tunnel. Once tunnel is ready, it tells
+// service manager and sends status updates on state changes and every
+// notifyStatusInterval until tunnel is closed.
+func notifyState(t *tunnel.Tunnel) {
+	changes := t.StateChanges()
+	go func() {
+		ticker := time.NewTicker(notifyStatusInterval)
+		defer ticker.Stop()
+		ready := t.Ready()
+		notify := len(os.Getenv("NOTIFY_SOCKET")) > 0
+		for {
+			select {
+			case <-ready:
+				ready = nil
+				if t.State() == tunnel.StateClosed {
+					continue
+				}
+				err := sdNotify("READY=1", tunnelStatus(t))
+				if err != nil {
+					log.Println("Notify service manager error:", err)
+					notify = false
+				}
+			case change, ok := <-changes:
+				if !ok {
+					return
+				}
+				if change.Err != nil {
+					log.Printf("Tunnel is %s: %v", change.State, change.Err)
+				} else {
+					log.Printf("Tunnel is %s", change.State)
+				}
+				if notify && ready == nil {
+					sdNotify(tunnelStatus(t))
+				}
+			case <-ticker.C:
+				if notify && ready == nil {
+					sdNotify(tunnelStatus(t))
+				}
+			}
+		}
+	}()
+}
+
+// signalHandler closes the tunnel and admin server set to it on SIGINT or
+// SIGTERM so that tunnel exits gracefully. If they are not set yet, e.g.
+// while tunnel is being created, it removes pid file and exits at once. A
+// second signal exits immediately.
+type signalHandler struct {
+	lock     sync.Mutex
+	tunnel   *tunnel.Tunnel
+	admin    *tunnel.AdminServer
+	stopping bool
+}
+
+// handleSignals starts handling signals, which should be done before pid
+// file is written so that it's removed on signals.
+func handleSignals() *signalHandler {
+	h := &signalHandler{}
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		log.Printf("Received %v, shutting down", sig)
+		sdNotify("STOPPING=1")
+		h.lock.Lock()
+		h.stopping = true
+		t, admin := h.tunnel, h.admin
+		h.lock.Unlock()
+		if t == nil {
+			removePIDFile()
+			os.Exit(0)
+		}
+		if admin != nil {
+			admin.Close()
+		}
+		t.Close()
+
+		sig = <-c
+		log.Printf("Received %v again, exiting", sig)
+		removePIDFile()
+		os.Exit(exitRuntimeError)
+	}()
+	return h
+}
+
+// set sets the tunnel and admin server to close on signals, or closes them
+// if a signal is already handled.
+func (h *signalHandler) set(t *tunnel.Tunnel, admin *tunnel.AdminServer) {
+	h.lock.Lock()
+	h.tunnel, h.admin = t, admin
+	stopping := h.stopping
+	h.lock.Unlock()
+
+	if stopping {
+		if admin != nil {
+			admin.Close()
+		}
+		t.Close()
+	}
+}
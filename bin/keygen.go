@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/nknorg/nkn-sdk-go"
+)
+
+func init() {
+	subcommands["keygen"] = runKeygen
+}
+
+func runKeygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	identifier := fs.String("i", "", "NKN address identifier")
+	output := fs.String("o", "", "write secret seed to this file instead of stdout, which should not exist")
+	fs.Parse(args)
+
+	account, err := nkn.NewAccount(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	seedHex := hex.EncodeToString(account.Seed())
+
+	if len(*output) > 0 {
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = f.WriteString(seedHex + "\n")
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Seed file:", *output)
+	} else {
+		fmt.Println("Seed:", seedHex)
+	}
+
+	pubKey := hex.EncodeToString(account.PubKey())
+	addr := pubKey
+	if len(*identifier) > 0 {
+		addr = *identifier + "." + pubKey
+	}
+	fmt.Println("Public key:", pubKey)
+	fmt.Println("Address:", addr)
+	fmt.Println("Wallet address:", account.WalletAddress())
+}
@@ -1,47 +1,69 @@
 package main
 
 import (
-	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"strings"
 
-	"github.com/nknorg/ncp-go"
+	"dario.cat/mergo"
 	"github.com/nknorg/nkn-sdk-go"
-	ts "github.com/nknorg/nkn-tuna-session"
 	tunnel "github.com/nknorg/nkn-tunnel"
 	"github.com/nknorg/nkngomobile"
-	"github.com/nknorg/tuna/geo"
 )
 
 var (
 	Version string
 )
 
+// subcommands are run by the first argument, e.g. "nkn-tunnel bench".
+var subcommands = map[string]func(args []string){}
+
 func main() {
-	numClients := flag.Int("n", 4, "number of clients")
-	seedHex := flag.String("s", "", "secret seed")
-	identifier := flag.String("i", "", "NKN address identifier")
-	from := flag.String("from", "", `listening at address (omitted or "nkn" for listening on nkn address, ip:port for tcp address)`)
-	to := flag.String("to", "", "dialing to address (nkn address or ip:port)")
-	dialTimeout := flag.Int("t", 0, "dial timeout in milliseconds")
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
+	}
+
+	cf := addClientFlags(flag.CommandLine)
+	from := flag.String("from", "", `listening at address (omitted or "nkn" for listening on nkn address, ip:port for tcp address, unix:path for unix socket, or tcp://, udp://, unix:// URI)`)
+	to := flag.String("to", "", "dialing to address (nkn address, ip:port, unix:path, or nkn://, tcp://, udp://, unix:// URI)")
 	acceptAddr := flag.String("accept", "", "accept incoming nkn address regex, separated by comma")
-	useTuna := flag.Bool("tuna", false, "use tuna instead of nkn client for nkn session")
-	tunaCountry := flag.String("country", "", `tuna service node allowed country code, separated by comma, e.g. "US" or "US,CN"`)
-	tunaServiceName := flag.String("tsn", "", "tuna reverse service name")
-	tunaSubscriptionPrefix := flag.String("tsp", "", "tuna subscription prefix")
-	tunaMaxPrice := flag.String("tuna-max-price", "0.01", "tuna max price in unit of NKN/MB")
-	tunaMinFee := flag.String("tuna-min-fee", "0.00001", "tuna nanopay minimal txn fee")
-	tunaFeeRatio := flag.Float64("tuna-fee-ratio", 0.1, "tuna nanopay txn fee ratio")
-	tunaDownloadGeoDB := flag.Bool("tuna-download-geo-db", false, "download tuna geo db to disk")
-	tunaGeoDBPath := flag.String("tuna-geo-db-path", ".", "path to store tuna geo db")
-	tunaMeasureBandwidth := flag.Bool("tuna-measure-bandwidth", false, "tuna measure bandwidth")
-	tunaMeasurementBytesDownLink := flag.Int("tuna-measure-bandwidth-bytes", 1, "tuna measure bandwidth bytes to transmit")
-	mtu := flag.Int("mtu", 0, "ncp session mtu")
-	rpcAddr := flag.String("rpc", "", "Seed RPC server address, separated by comma")
-	udp := flag.Bool("udp", false, "support udp")
+	udp := flag.Bool("udp", false, "support udp, requires -handshake without tuna")
+	udpOverSession := flag.Bool("udp-over-session", false, "carry udp inside nkn sessions instead of tuna udp, for networks that block udp (requires -handshake, which also enables it as fallback when tuna udp fails)")
+	udpFragmentSize := flag.Int("udp-fragment-size", 0, "split udp datagrams into fragments no larger than this size on nkn side, 0 is for no fragmentation, should be set on both side")
+	udpIdleTime := flag.Int("udp-idle-time", 0, "seconds to purge idle udp flows, 0 is for no purge")
+	udpMaxFlows := flag.Int("udp-max-flows", 0, "maximum number of udp flows, 0 is for no limit")
+	handshake := flag.Bool("handshake", false, "exchange handshake at the beginning of each session dialed to nkn, should be enabled on remote as well, accepted sessions without handshake are still handled as plain sessions")
+	remoteForwardAddr := flag.String("remote-forward-addr", "", "ask tunnel server at this nkn address to listen at -remote-forward-port and forward connections back (requires listening on nkn and -handshake)")
+	remoteForwardPort := flag.Int("remote-forward-port", 0, "port for tunnel server to listen at for remote forward")
+	remoteForwardPorts := flag.String("remote-forward-ports", "", `allowed port range for remote forward requests, e.g. "20000-20100" (requires -handshake)`)
+	remoteForwardHost := flag.String("remote-forward-host", "127.0.0.1", "host for remote forward listeners to bind to")
+	sessionPool := flag.Int("session-pool", 0, "number of pre-established idle sessions to keep to nkn to address, 0 is for no pool")
+	sessionPoolMaxAge := flag.Int("session-pool-max-age", 60, "seconds to drop idle pooled sessions, 0 is for no limit")
+	sessionPoolCheckInterval := flag.Int("session-pool-check-interval", 5, "seconds between health checks of pooled sessions")
+	compression := flag.String("compression", "", `compress tcp connections on nkn side, "deflate" or "none", negotiated with remote (requires -handshake)`)
+	mux := flag.Bool("mux", false, "multiplex tcp connections to the same nkn address over one session, should be enabled on both side (requires -handshake)")
+	dynamicTo := flag.Bool("dynamic-to", false, `dial destination requested by remote (e.g. -to "nkn://<addr>?dest=example.com:443" on remote) instead of -to, checked by -egress-* policy (requires -handshake)`)
+	egressAllowCIDR := flag.String("egress-allow-cidr", "", "allowed dynamic destination ip ranges, separated by comma, loopback and private ranges are denied unless allowed here")
+	egressDenyCIDR := flag.String("egress-deny-cidr", "", "denied dynamic destination ip ranges, separated by comma")
+	egressAllowHost := flag.String("egress-allow-host", "", `allowed dynamic destination host patterns, separated by comma, e.g. "*.example.com"`)
+	egressDenyHost := flag.String("egress-deny-host", "", "denied dynamic destination host patterns, separated by comma")
+	egressAllowPort := flag.String("egress-allow-port", "", `allowed dynamic destination ports or port ranges, separated by comma, e.g. "80,443,8000-9000"`)
+	tunaBudgetHourly := flag.String("tuna-budget-hourly", "", "max estimated NKN spent on tuna nodes per hour when listening with tuna, empty is for no limit")
+	tunaBudgetDaily := flag.String("tuna-budget-daily", "", "max estimated NKN spent on tuna nodes per day (UTC) when listening with tuna, empty is for no limit")
+	tunaBudgetTotal := flag.String("tuna-budget-total", "", "max estimated NKN spent on tuna nodes in total when listening with tuna, empty is for no limit")
+	tunaBudgetAction := flag.String("tuna-budget-action", tunnel.TunaBudgetActionStop, `action when a tuna budget is hit, "stop" accepting sessions or fall back to "nkn" sessions`)
+	tunaPreferredNodes := flag.String("tuna-preferred-nodes", "", "nkn addresses of tuna nodes to connect to in order if reachable when listening with tuna, separated by comma")
+	tunaBannedNodes := flag.String("tuna-banned-nodes", "", "nkn addresses, ips or cidrs of tuna nodes never to connect to when listening with tuna, separated by comma")
+	tunaReputationFile := flag.String("tuna-reputation-file", "", "file to persist reputation of tuna nodes, proven nodes are preferred after restart")
 	verbose := flag.Bool("v", false, "show logs on dialing/accepting connection")
+	adminAddr := flag.String("admin-addr", "", `listen admin http api at loopback address or unix socket, e.g. "127.0.0.1:9000" or "unix:/run/nkn-tunnel.sock"`)
+	adminTokenFile := flag.String("admin-token-file", "", "file of admin api token, or use "+adminTokenEnv+" env")
+	pidFilePath := flag.String("pid-file", "", "write process id to this file, removed on exit")
 	version := flag.Bool("version", false, "print version")
 
 	flag.Parse()
@@ -51,18 +73,13 @@ func main() {
 		return
 	}
 
-	if len(*to) == 0 {
-		log.Fatal("To address is empty")
-	}
-
-	seed, err := hex.DecodeString(*seedHex)
-	if err != nil {
-		log.Fatal(err)
+	if len(*to) == 0 && len(*remoteForwardPorts) == 0 && !*dynamicTo {
+		configFatal("To address is empty")
 	}
 
-	account, err := nkn.NewAccount(seed)
+	account, err := cf.account()
 	if err != nil {
-		log.Fatal(err)
+		configFatal(err)
 	}
 
 	var acceptAddrs *nkngomobile.StringArray
@@ -70,64 +87,103 @@ func main() {
 		acceptAddrs = nkn.NewStringArrayFromString(strings.ReplaceAll(*acceptAddr, ",", " "))
 	}
 
-	var seedRPCServerAddr *nkngomobile.StringArray
-	if len(*rpcAddr) > 0 {
-		seedRPCServerAddr = nkn.NewStringArrayFromString(strings.ReplaceAll(*rpcAddr, ",", " "))
+	config := cf.config()
+	err = mergo.Merge(config, &tunnel.Config{
+		AcceptAddrs:        acceptAddrs,
+		UDP:                *udp,
+		UDPIdleTime:        int32(*udpIdleTime),
+		UDPMaxFlows:        *udpMaxFlows,
+		UDPOverSession:     *udpOverSession,
+		UDPFragmentSize:    *udpFragmentSize,
+		Verbose:            *verbose,
+		Handshake:          *handshake,
+		RemoteForwardAddr:  *remoteForwardAddr,
+		RemoteForwardPort:  *remoteForwardPort,
+		RemoteForwardPorts: *remoteForwardPorts,
+		RemoteForwardHost:  *remoteForwardHost,
+		Mux:                *mux,
+		Compression:        *compression,
+
+		SessionPoolMinIdle:       *sessionPool,
+		SessionPoolMaxAge:        int32(*sessionPoolMaxAge),
+		SessionPoolCheckInterval: int32(*sessionPoolCheckInterval),
+
+		TunaBudgetHourly: *tunaBudgetHourly,
+		TunaBudgetDaily:  *tunaBudgetDaily,
+		TunaBudgetTotal:  *tunaBudgetTotal,
+		TunaBudgetAction: *tunaBudgetAction,
+
+		TunaPreferredNodes: splitList(*tunaPreferredNodes),
+		TunaBannedNodes:    splitList(*tunaBannedNodes),
+		TunaReputationFile: *tunaReputationFile,
+
+		DynamicTo: *dynamicTo,
+		EgressPolicy: &tunnel.EgressPolicy{
+			AllowCIDRs: splitList(*egressAllowCIDR),
+			DenyCIDRs:  splitList(*egressDenyCIDR),
+			AllowHosts: splitList(*egressAllowHost),
+			DenyHosts:  splitList(*egressDenyHost),
+			AllowPorts: splitList(*egressAllowPort),
+		},
+	})
+	if err != nil {
+		configFatal(err)
 	}
 
-	sessionConfig := &ncp.Config{
-		MTU: int32(*mtu),
-	}
-	clientConfig := &nkn.ClientConfig{
-		SeedRPCServerAddr: seedRPCServerAddr,
-		SessionConfig:     sessionConfig,
-	}
-	walletConfig := &nkn.WalletConfig{
-		SeedRPCServerAddr: seedRPCServerAddr,
-	}
-	dialConfig := &nkn.DialConfig{
-		DialTimeout: int32(*dialTimeout),
+	var token string
+	if len(*adminAddr) > 0 {
+		token, err = adminToken(*adminTokenFile)
+		if err != nil {
+			configFatal(err)
+		}
 	}
 
-	var tsConfig *ts.Config
-	if *useTuna {
-		countries := strings.Split(*tunaCountry, ",")
-		locations := make([]geo.Location, len(countries))
-		for i := range countries {
-			locations[i].CountryCode = strings.TrimSpace(countries[i])
-		}
+	signals := handleSignals()
 
-		tsConfig = &ts.Config{
-			NumTunaListeners:             *numClients,
-			SessionConfig:                sessionConfig,
-			TunaIPFilter:                 &geo.IPFilter{Allow: locations},
-			TunaServiceName:              *tunaServiceName,
-			TunaSubscriptionPrefix:       *tunaSubscriptionPrefix,
-			TunaMaxPrice:                 *tunaMaxPrice,
-			TunaMinNanoPayFee:            *tunaMinFee,
-			TunaNanoPayFeeRatio:          *tunaFeeRatio,
-			TunaDownloadGeoDB:            *tunaDownloadGeoDB,
-			TunaGeoDBPath:                *tunaGeoDBPath,
-			TunaMeasureBandwidth:         *tunaMeasureBandwidth,
-			TunaMeasurementBytesDownLink: int32(*tunaMeasurementBytesDownLink),
+	if len(*pidFilePath) > 0 {
+		err = writePIDFile(*pidFilePath)
+		if err != nil {
+			fatal(err)
 		}
 	}
 
-	config := &tunnel.Config{
-		NumSubClients:     *numClients,
-		AcceptAddrs:       acceptAddrs,
-		ClientConfig:      clientConfig,
-		WalletConfig:      walletConfig,
-		DialConfig:        dialConfig,
-		TunaSessionConfig: tsConfig,
-		UDP:               *udp,
-		Verbose:           *verbose,
+	t, err := tunnel.NewTunnel(account, *cf.identifier, *from, *to, *cf.useTuna, config, nil)
+	if err != nil {
+		fatal(err)
+	}
+	signals.set(t, nil)
+
+	var admin *tunnel.AdminServer
+	if len(*adminAddr) > 0 {
+		admin, err = tunnel.NewAdminServer(*adminAddr, token, []*tunnel.Tunnel{t})
+		if err != nil {
+			t.Close()
+			fatal(err)
+		}
+		log.Println("Admin api is listening at", admin.Addr())
+		go func() {
+			log.Println("Admin api error:", admin.Serve())
+		}()
 	}
 
-	t, err := tunnel.NewTunnel(account, *identifier, *from, *to, *useTuna, config, nil)
+	signals.set(t, admin)
+	notifyState(t)
+
+	err = t.Start()
+	removePIDFile()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
+}
 
-	log.Fatal(t.Start())
+// splitList splits a comma separated list, and returns nil for empty string.
+func splitList(s string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	list := strings.Split(s, ",")
+	for i := range list {
+		list[i] = strings.TrimSpace(list[i])
+	}
+	return list
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	tunnel "github.com/nknorg/nkn-tunnel"
+)
+
+func init() {
+	subcommands["ping"] = runPing
+}
+
+func runPing(args []string) {
+	fs := flag.NewFlagSet("ping", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: nkn-tunnel ping [flags] <nkn-address>")
+		fs.PrintDefaults()
+	}
+	cf := addClientFlags(fs)
+	count := fs.Int("c", 4, "number of pings")
+	interval := fs.Duration("interval", time.Second, "interval between pings")
+	handshake := fs.Bool("handshake", false, "exchange ping handshake to measure rtt, only if the server has -handshake enabled")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	addr := fs.Arg(0)
+
+	account, err := cf.account()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	config := cf.config()
+	config.Handshake = *handshake
+
+	p, err := tunnel.NewPinger(account, *cf.identifier, *cf.useTuna, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer p.Close()
+
+	var succeeded, answered int
+	var totalSetup, totalRTT time.Duration
+	for i := 1; i <= *count; i++ {
+		if i > 1 {
+			time.Sleep(*interval)
+		}
+
+		r := p.Ping(addr)
+		if r.TunaErr != nil {
+			fmt.Printf("seq=%d tuna failed: %v\n", i, r.TunaErr)
+		}
+		if r.Err != nil {
+			fmt.Printf("seq=%d failed: %v\n", i, r.Err)
+			continue
+		}
+		succeeded++
+		totalSetup += r.SetupTime
+
+		line := fmt.Sprintf("seq=%d mode=%s setup=%v", i, r.Mode, r.SetupTime.Round(time.Millisecond))
+		if r.RTT > 0 {
+			answered++
+			totalRTT += r.RTT
+			line += fmt.Sprintf(" rtt=%v", r.RTT.Round(time.Millisecond))
+		}
+		if r.HandshakeErr != nil {
+			line += fmt.Sprintf(" handshake: %v", r.HandshakeErr)
+		}
+		fmt.Println(line)
+	}
+
+	fmt.Printf("--- %s ping statistics ---\n", addr)
+	fmt.Printf("%d sessions, %d established, %d failed\n", *count, succeeded, *count-succeeded)
+	if succeeded > 0 {
+		fmt.Printf("avg setup=%v", (totalSetup / time.Duration(succeeded)).Round(time.Millisecond))
+		if answered > 0 {
+			fmt.Printf(" avg rtt=%v", (totalRTT / time.Duration(answered)).Round(time.Millisecond))
+		}
+		fmt.Println()
+	}
+	if succeeded == 0 {
+		// os.Exit skips deferred Close.
+		p.Close()
+		os.Exit(1)
+	}
+}
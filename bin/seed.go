@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"golang.org/x/term"
+)
+
+// Environment variables of hex encoded secret seed and admin api token.
+const (
+	seedEnv       = "NKN_TUNNEL_SEED"
+	adminTokenEnv = "NKN_TUNNEL_ADMIN_TOKEN"
+)
+
+// account returns the account of the seed from -s, -seed-file or -wallet, or
+// from seedEnv if none of them is given. A random account is only used if
+// -new-account is set and no seed is given.
+func (f *clientFlags) account() (*nkn.Account, error) {
+	var sources []string
+	if len(*f.seedHex) > 0 {
+		sources = append(sources, "-s")
+	}
+	if len(*f.seedFile) > 0 {
+		sources = append(sources, "-seed-file")
+	}
+	if len(*f.walletFile) > 0 {
+		sources = append(sources, "-wallet")
+	}
+	if len(sources) > 1 {
+		return nil, fmt.Errorf("seed is given by more than one of %s", strings.Join(sources, ", "))
+	}
+	if len(sources) > 0 && len(os.Getenv(seedEnv)) > 0 {
+		log.Printf("Seed is given by %s, ignoring %s env", sources[0], seedEnv)
+	}
+
+	var seedHex string
+	switch {
+	case len(*f.seedHex) > 0:
+		seedHex = *f.seedHex
+	case len(*f.seedFile) > 0:
+		b, err := readSecretFile(*f.seedFile)
+		if err != nil {
+			return nil, err
+		}
+		seedHex = string(b)
+	case len(*f.walletFile) > 0:
+		return f.walletAccount()
+	case len(os.Getenv(seedEnv)) > 0:
+		seedHex = os.Getenv(seedEnv)
+	case *f.newAccount:
+		log.Println("Using a new random seed, NKN address will change on restart.")
+		return nkn.NewAccount(nil)
+	default:
+		return nil, fmt.Errorf("seed is required by -s, -seed-file, -wallet or %s env, use keygen subcommand to generate one, or -new-account to use a random one", seedEnv)
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(seedHex))
+	if err != nil {
+		return nil, fmt.Errorf("invalid seed: %v", err)
+	}
+	return nkn.NewAccount(seed)
+}
+
+// walletAccount decrypts the account of wallet file with password from
+// -password-file or prompt.
+func (f *clientFlags) walletAccount() (*nkn.Account, error) {
+	walletJSON, err := os.ReadFile(*f.walletFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var password []byte
+	if len(*f.passwordFile) > 0 {
+		password, err = readSecretFile(*f.passwordFile)
+		if err != nil {
+			return nil, err
+		}
+		password = []byte(strings.TrimRight(string(password), "\r\n"))
+	} else {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return nil, errors.New("wallet password is required, use -password-file when stdin is not a terminal")
+		}
+		fmt.Fprint(os.Stderr, "Wallet password: ")
+		password, err = term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	wallet, err := nkn.WalletFromJSON(string(walletJSON), &nkn.WalletConfig{Password: string(password)})
+	if err != nil {
+		return nil, err
+	}
+	return nkn.NewAccount(wallet.Seed())
+}
+
+// readSecretFile reads a file that should not be accessible by group or
+// others.
+func readSecretFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s is accessible by group or others, run chmod 600 %s", path, path)
+	}
+	return os.ReadFile(path)
+}
+
+// adminToken returns the admin api token from tokenFile or adminTokenEnv.
+func adminToken(tokenFile string) (string, error) {
+	if len(tokenFile) > 0 {
+		b, err := readSecretFile(tokenFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	if token := os.Getenv(adminTokenEnv); len(token) > 0 {
+		return token, nil
+	}
+	return "", fmt.Errorf("admin token is required by -admin-token-file or %s env", adminTokenEnv)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nknorg/nkn-sdk-go"
+)
+
+func TestAccountSeedPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	flagAccount, err := nkn.NewAccount(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envAccount, err := nkn.NewAccount(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(seedEnv, hex.EncodeToString(envAccount.Seed()))
+
+	seedFile := filepath.Join(dir, "seed")
+	if err := os.WriteFile(seedFile, []byte(hex.EncodeToString(flagAccount.Seed())+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	wallet, err := nkn.NewWallet(flagAccount, &nkn.WalletConfig{Password: "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	walletJSON, err := wallet.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	walletFile := filepath.Join(dir, "wallet.json")
+	passwordFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(walletFile, []byte(walletJSON), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(passwordFile, []byte("password\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		args     []string
+		expected *nkn.Account
+	}{
+		{"env", nil, envAccount},
+		{"-s", []string{"-s", hex.EncodeToString(flagAccount.Seed())}, flagAccount},
+		{"-seed-file", []string{"-seed-file", seedFile}, flagAccount},
+		{"-wallet", []string{"-wallet", walletFile, "-password-file", passwordFile}, flagAccount},
+	}
+	for _, tc := range testCases {
+		fs := flag.NewFlagSet(tc.name, flag.ContinueOnError)
+		f := addClientFlags(fs)
+		if err := fs.Parse(tc.args); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		account, err := f.account()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !bytes.Equal(account.Seed(), tc.expected.Seed()) {
+			t.Fatalf("%s: got seed of another source", tc.name)
+		}
+	}
+}
+
+func TestAccountSeedRequired(t *testing.T) {
+	t.Setenv(seedEnv, "")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	f := addClientFlags(fs)
+	if _, err := f.account(); err == nil {
+		t.Fatal("account is created without seed")
+	}
+	fs.Parse([]string{"-new-account"})
+	if _, err := f.account(); err != nil {
+		t.Fatal(err)
+	}
+}
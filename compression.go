@@ -0,0 +1,148 @@
+package tunnel
+
+import (
+	"compress/flate"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Compression algorithms of tunneled connections.
+const (
+	CompressionNone    = "none"
+	CompressionDeflate = "deflate"
+)
+
+var (
+	ErrUnknownCompression = errors.New("unknown compression")
+)
+
+func checkCompression(compression string) error {
+	switch compression {
+	case "", CompressionNone, CompressionDeflate:
+		return nil
+	default:
+		return ErrUnknownCompression
+	}
+}
+
+// compressionEnabled returns whether compression should be offered or
+// accepted in handshake.
+func (c *Config) compressionEnabled() bool {
+	return len(c.Compression) > 0 && c.Compression != CompressionNone
+}
+
+// offeredCompression returns the compression algorithms offered in handshake
+// request.
+func (t *Tunnel) offeredCompression() []string {
+	if !t.config.compressionEnabled() {
+		return nil
+	}
+	return []string{t.config.Compression}
+}
+
+// negotiateCompression returns the compression algorithm to use among the
+// ones offered by remote, or empty if none is supported.
+func (t *Tunnel) negotiateCompression(offered []string) string {
+	if !t.config.compressionEnabled() {
+		return ""
+	}
+	for _, c := range offered {
+		if c == t.config.Compression {
+			return c
+		}
+	}
+	return ""
+}
+
+// compressionStats counts bytes of compressed conns.
+type compressionStats struct {
+	rawBytes        uint64
+	compressedBytes uint64
+}
+
+// wrapCompression returns conn compressed by the negotiated algorithm.
+func (t *Tunnel) wrapCompression(conn net.Conn, compression string) net.Conn {
+	switch compression {
+	case CompressionDeflate:
+		return newDeflateConn(conn, &t.compressionStats)
+	default:
+		return conn
+	}
+}
+
+// countingConn counts bytes read from and written to conn.
+type countingConn struct {
+	net.Conn
+	count *uint64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(c.count, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(c.count, uint64(n))
+	return n, err
+}
+
+// deflateConn compresses data written to conn and decompresses data read from
+// conn. Each write is flushed so that interactive traffic is not delayed.
+type deflateConn struct {
+	net.Conn
+	stats     *compressionStats
+	r         io.ReadCloser
+	writeLock sync.Mutex
+	w         *flate.Writer
+	closeOnce sync.Once
+}
+
+func newDeflateConn(conn net.Conn, stats *compressionStats) *deflateConn {
+	cc := &countingConn{Conn: conn, count: &stats.compressedBytes}
+	w, _ := flate.NewWriter(cc, flate.BestSpeed)
+	return &deflateConn{
+		Conn:  conn,
+		stats: stats,
+		r:     flate.NewReader(cc),
+		w:     w,
+	}
+}
+
+func (c *deflateConn) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	atomic.AddUint64(&c.stats.rawBytes, uint64(n))
+	return n, err
+}
+
+func (c *deflateConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	n, err := c.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	err = c.w.Flush()
+	if err != nil {
+		return n, err
+	}
+	atomic.AddUint64(&c.stats.rawBytes, uint64(n))
+	return n, nil
+}
+
+// Close ends the compressed stream before closing conn, so that remote reads
+// EOF instead of unexpected EOF.
+func (c *deflateConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.writeLock.Lock()
+		c.w.Close()
+		c.writeLock.Unlock()
+		c.r.Close()
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,108 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestTunnel creates a tunnel listening on NKN that forwards to an echo
+// server, without NKN clients. Sessions are handed to it by handleConn.
+func newTestTunnel(t *testing.T, config *Config) (*Tunnel, *Endpoint) {
+	config, err := MergedConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	to, err := ParseEndpoint(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Tunnel{
+		fromNKN:     true,
+		config:      config,
+		toEndpoint:  to,
+		conns:       make(map[uint64]*trackedConn),
+		muxSessions: make(map[string]*muxSession),
+	}, to
+}
+
+// echo writes msg to conn and checks it's echoed back.
+func echo(t *testing.T, conn net.Conn, msg string) {
+	_, err := conn.Write([]byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != msg {
+		t.Fatalf("got %q, expected %q", b, msg)
+	}
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	testCases := []struct {
+		name        string
+		local       string
+		remote      string
+		handshake   bool
+		compression string
+	}{
+		{"plain remote", CompressionDeflate, "", false, ""},
+		{"remote without compression", "", CompressionDeflate, true, ""},
+		{"mismatched compression", CompressionDeflate, "zstd", true, ""},
+		{"same compression", CompressionDeflate, CompressionDeflate, true, CompressionDeflate},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tun, to := newTestTunnel(t, &Config{Handshake: true, Compression: tc.local})
+			local, remote := net.Pipe()
+			defer remote.Close()
+			go tun.handleConn(local, to, ModeNKN)
+
+			conn := net.Conn(remote)
+			if tc.handshake {
+				resp, err := dialHandshake(remote, &handshakeRequest{
+					Type:        handshakeTypeConnect,
+					Compression: []string{tc.remote},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.Compression != tc.compression {
+					t.Fatalf("negotiated compression %q, expected %q", resp.Compression, tc.compression)
+				}
+				conn = tun.wrapCompression(remote, resp.Compression)
+			}
+
+			echo(t, conn, "hello")
+			echo(t, conn, "world")
+			if compressed := atomic.LoadUint64(&tun.compressionStats.compressedBytes) > 0; compressed != (tc.compression != "") {
+				t.Fatalf("compressed %v, expected %v", compressed, tc.compression != "")
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package tunnel
 
 import (
+	"fmt"
+
 	"dario.cat/mergo"
 	"github.com/nknorg/nkn-sdk-go"
 	ts "github.com/nknorg/nkn-tuna-session"
@@ -18,8 +20,113 @@ type Config struct {
 	TunaSessionConfig *ts.Config
 	UDP               bool
 	UDPIdleTime       int32 // Seconds. Time to purge idle udp connections, 0 is for no purge.
-	Verbose           bool
-	TunaNode          *types.Node
+	UDPMaxFlows       int   // Maximum number of udp flows, 0 is for no limit.
+
+	// UDPOverSession carries udp datagrams inside sessions instead of tuna udp
+	// connections, for networks that block udp, and requires Handshake. It's
+	// also used as fallback when tuna udp fails if Handshake is enabled, even
+	// if UDPOverSession is not set. Without Handshake there is no fallback.
+	UDPOverSession bool
+
+	// UDPFragmentSize splits udp datagrams larger than it into fragments on
+	// NKN side, 0 is for no fragmentation. Remote should set it as well to
+	// reassemble fragments, within UDPReassemblyTimeout (milliseconds) and
+	// UDPReassemblyMaxBytes of buffer. Datagrams are passed through unchanged
+	// if it's 0, so tunnels without fragmentation stay compatible.
+	UDPFragmentSize       int
+	UDPReassemblyTimeout  int32
+	UDPReassemblyMaxBytes int
+	Verbose               bool
+	TunaNode              *types.Node
+
+	// Handshake exchanges a handshake at the beginning of each session dialed
+	// to NKN, so remote should enable it as well. Incoming sessions are
+	// handled as plain sessions if they don't start with a handshake, so
+	// remotes without handshake can still connect. Features that rely on it
+	// such as remote forward require it to be enabled. To detect plain
+	// sessions without stalling upstreams that speak first, upstream is
+	// dialed as soon as a session is accepted, and the connection is closed
+	// unused if the session turns out to be a handshake for anything other
+	// than connecting to it.
+	Handshake bool
+
+	// Remote forward asks the tunnel server at RemoteForwardAddr to listen at
+	// RemoteForwardPort and forward connections back to this tunnel, which
+	// should be listening on NKN. The server only accepts ports within its
+	// RemoteForwardPorts range (e.g. "20000-20100") and binds them to
+	// RemoteForwardHost.
+	RemoteForwardAddr  string
+	RemoteForwardPort  int
+	RemoteForwardPorts string
+	RemoteForwardHost  string
+
+	// SessionPoolMinIdle pre-established sessions are kept to NKN to address
+	// to cut connection setup latency. Idle sessions are dropped if closed or
+	// older than SessionPoolMaxAge (seconds, 0 is for no limit), checked every
+	// SessionPoolCheckInterval (seconds). Without handshake, remote dials its
+	// to address once a session is established, so pooled sessions keep
+	// upstream connections open on remote while idle. With handshake, idle
+	// sessions are kept alive by ping handshake.
+	SessionPoolMinIdle       int
+	SessionPoolMaxAge        int32
+	SessionPoolCheckInterval int32
+
+	// Compression compresses tunneled TCP connections to and from NKN, e.g.
+	// "deflate". It requires Handshake and is negotiated in it, so connections
+	// are not compressed unless both sides use the same compression, and
+	// plain sessions from remotes without handshake are not compressed.
+	Compression string
+
+	// Mux multiplexes TCP connections to the same NKN address over one
+	// persistent session instead of dialing a session for each connection.
+	// It requires Handshake. Remote should enable Mux as well, otherwise it
+	// rejects mux in handshake and a session is dialed for each connection as
+	// usual.
+	Mux bool
+
+	// DynamicTo lets a tunnel listening on NKN dial the destination requested
+	// by remote, e.g. "nkn://pubkey?dest=example.com:443", instead of its to
+	// address. It requires Handshake. Requested destinations are checked
+	// against EgressPolicy. If EgressPolicy is nil, any destination is
+	// allowed except internal addresses like loopback and private ranges.
+	DynamicTo    bool
+	EgressPolicy *EgressPolicy
+
+	// Tuna budgets limit the estimated NKN spent on tuna nodes by a tunnel
+	// listening on NKN with tuna, in the current hour, the current day (UTC)
+	// and since the tunnel is created, e.g. "0.5". Empty or 0 is for no limit.
+	// When a budget is hit, the tunnel stops accepting sessions if
+	// TunaBudgetAction is "stop" (default), or only stops accepting tuna
+	// sessions so that remote falls back to NKN sessions if it's "nkn", until
+	// the budget resets.
+	TunaBudgetHourly string
+	TunaBudgetDaily  string
+	TunaBudgetTotal  string
+	TunaBudgetAction string
+
+	// TunaDialMode is how a tunnel using tuna dials NKN addresses: "tuna"
+	// (default) dials tuna sessions only, "fallback" dials an NKN session if
+	// tuna session fails or is not established within TunaFallbackTimeout
+	// (milliseconds, 0 is for waiting until tuna fails), and "race" dials an
+	// NKN session TunaRaceDelay (milliseconds) after tuna session and uses
+	// whichever is established first. Remote should accept NKN sessions, i.e.
+	// listen on NKN with or without tuna.
+	TunaDialMode        string
+	TunaFallbackTimeout int32
+	TunaRaceDelay       int32
+
+	// TunaPreferredNodes are NKN addresses of tuna nodes that a tunnel
+	// listening on NKN with tuna connects to if reachable, in order, instead
+	// of nodes selected by tuna. TunaBannedNodes are NKN addresses, IPs or
+	// CIDRs of tuna nodes never to connect to. Both are ignored if TunaNode is
+	// set.
+	TunaPreferredNodes []string
+	TunaBannedNodes    []string
+
+	// TunaReputationFile persists the reputation of tuna nodes scored by
+	// latency, throughput and disconnects. Proven nodes are preferred after
+	// restart, and unreliable ones are avoided. Empty is for no persistence.
+	TunaReputationFile string
 }
 
 var defaultConfig = Config{
@@ -32,7 +139,16 @@ var defaultConfig = Config{
 	TunaSessionConfig: nil,
 	UDP:               false,
 	UDPIdleTime:       0,
-	Verbose:           false,
+
+	UDPFragmentSize:       0,
+	UDPReassemblyTimeout:  5000,
+	UDPReassemblyMaxBytes: 4 << 20,
+	Verbose:               false,
+	RemoteForwardHost:     "127.0.0.1",
+
+	SessionPoolMinIdle:       0,
+	SessionPoolMaxAge:        60,
+	SessionPoolCheckInterval: 5,
 }
 
 func DefaultConfig() *Config {
@@ -50,3 +166,27 @@ func MergedConfig(conf *Config) (*Config, error) {
 	}
 	return merged, nil
 }
+
+// checkHandshake checks that features relying on handshake are only enabled
+// with handshake.
+func (c *Config) checkHandshake() error {
+	if c.Handshake {
+		return nil
+	}
+	features := []struct {
+		name    string
+		enabled bool
+	}{
+		{"remote forward", len(c.RemoteForwardAddr) > 0 || len(c.RemoteForwardPorts) > 0},
+		{"mux", c.Mux},
+		{"compression", c.compressionEnabled()},
+		{"udp over session", c.UDPOverSession},
+		{"dynamic to", c.DynamicTo},
+	}
+	for _, f := range features {
+		if f.enabled {
+			return fmt.Errorf("%w by %s", ErrHandshakeRequired, f.name)
+		}
+	}
+	return nil
+}
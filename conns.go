@@ -0,0 +1,123 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrConnNotFound = errors.New("connection not found")
+)
+
+// ConnInfo is the info of an active tunneled connection.
+type ConnInfo struct {
+	ID   uint64 `json:"id"`
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Mode is the mode of the NKN session, ModeTuna or ModeNKN.
+	Mode      string    `json:"mode,omitempty"`
+	StartTime time.Time `json:"startTime"`
+}
+
+type trackedConn struct {
+	info     ConnInfo
+	fromConn net.Conn
+	toConn   net.Conn
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// pipe pipes data between fromConn and toConn, and tracks them as an active
+// connection until both directions are done. Mode is the mode of the NKN
+// session of the connection.
+func (t *Tunnel) pipe(fromConn, toConn net.Conn, mode string) {
+	c := &trackedConn{
+		info: ConnInfo{
+			From:      addrString(fromConn.RemoteAddr()),
+			To:        addrString(toConn.RemoteAddr()),
+			Mode:      mode,
+			StartTime: time.Now(),
+		},
+		fromConn: fromConn,
+		toConn:   toConn,
+	}
+
+	t.connsLock.Lock()
+	t.nextConnID++
+	c.info.ID = t.nextConnID
+	t.conns[c.info.ID] = c
+	t.totalConns++
+	switch mode {
+	case ModeTuna:
+		t.tunaConns++
+	case ModeNKN:
+		t.nknConns++
+	}
+	t.connsLock.Unlock()
+
+	pipe(fromConn, toConn, func() {
+		t.connsLock.Lock()
+		delete(t.conns, c.info.ID)
+		t.connsLock.Unlock()
+	})
+}
+
+// Conns returns the active tunneled connections ordered by ID.
+func (t *Tunnel) Conns() []*ConnInfo {
+	t.connsLock.Lock()
+	conns := make([]*ConnInfo, 0, len(t.conns))
+	for _, c := range t.conns {
+		info := c.info
+		conns = append(conns, &info)
+	}
+	t.connsLock.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	return conns
+}
+
+// KillConn closes the active tunneled connection of id.
+func (t *Tunnel) KillConn(id uint64) error {
+	t.connsLock.Lock()
+	c, ok := t.conns[id]
+	t.connsLock.Unlock()
+	if !ok {
+		return ErrConnNotFound
+	}
+
+	c.fromConn.Close()
+	c.toConn.Close()
+	return nil
+}
+
+// pipe copies data between a and b in both directions, and calls onClose
+// when both are done if it's not nil.
+func pipe(a, b net.Conn, onClose func()) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(a, b)
+		a.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(b, a)
+		b.Close()
+	}()
+	if onClose != nil {
+		go func() {
+			wg.Wait()
+			onClose()
+		}()
+	}
+}
@@ -0,0 +1,227 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrDynamicToNotAllowed = errors.New("dynamic destination is not allowed")
+	ErrDynamicToNotFromNKN = errors.New("dynamic destination is only supported when listening on NKN")
+	ErrEgressDenied        = errors.New("destination is denied by egress policy")
+	ErrNoDestination       = errors.New("no destination is requested")
+)
+
+// EgressPolicy decides which dynamic destinations a tunnel listening on NKN
+// can dial. Deny lists always apply. If both AllowHosts and AllowCIDRs are
+// empty, any destination not denied is allowed, otherwise destination should
+// match either of them. Loopback, private, link local, shared, unspecified
+// and multicast addresses are denied unless they are in AllowCIDRs, even if
+// their hostname is allowed. Host patterns are matched against hostname by
+// path.Match, e.g. "*.example.com". Ports are single ports or port ranges like
+// "8000-9000", empty means any port.
+type EgressPolicy struct {
+	AllowCIDRs []string
+	DenyCIDRs  []string
+	AllowHosts []string
+	DenyHosts  []string
+	AllowPorts []string
+}
+
+type egressChecker struct {
+	allowCIDRs []*net.IPNet
+	denyCIDRs  []*net.IPNet
+	allowHosts []string
+	denyHosts  []string
+	allowPorts [][2]int
+}
+
+func newEgressChecker(policy *EgressPolicy) (*egressChecker, error) {
+	c := &egressChecker{}
+	if policy == nil {
+		return c, nil
+	}
+
+	var err error
+	c.allowCIDRs, err = parseCIDRs(policy.AllowCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	c.denyCIDRs, err = parseCIDRs(policy.DenyCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	c.allowHosts, err = parseHostPatterns(policy.AllowHosts)
+	if err != nil {
+		return nil, err
+	}
+	c.denyHosts, err = parseHostPatterns(policy.DenyHosts)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range policy.AllowPorts {
+		min, max, err := parsePortRange(s)
+		if err != nil {
+			return nil, err
+		}
+		c.allowPorts = append(c.allowPorts, [2]int{min, max})
+	}
+
+	return c, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func parseHostPatterns(patterns []string) ([]string, error) {
+	hosts := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %s: %v", p, err)
+		}
+		hosts = append(hosts, p)
+	}
+	return hosts, nil
+}
+
+func matchHost(patterns []string, host string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// Shared address space for carrier-grade NAT, RFC 6598.
+	sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+	// "This network", RFC 1122.
+	thisNetwork = &net.IPNet{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(8, 32)}
+)
+
+// internalIP returns whether ip is an address that should not be reachable
+// by remote unless allowed explicitly.
+func internalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip) || thisNetwork.Contains(ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedIPs resolves host and returns its addresses allowed to dial.
+func (c *egressChecker) allowedIPs(ctx context.Context, host string, port int) ([]net.IP, error) {
+	if len(c.allowPorts) > 0 {
+		allowed := false
+		for _, r := range c.allowPorts {
+			if port >= r[0] && port <= r[1] {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, fmt.Errorf("%w: port %d", ErrEgressDenied, port)
+		}
+	}
+
+	allowAll := len(c.allowHosts) == 0 && len(c.allowCIDRs) == 0
+	hostAllowed := allowAll
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		if matchHost(c.denyHosts, host) {
+			return nil, fmt.Errorf("%w: host %s", ErrEgressDenied, host)
+		}
+		hostAllowed = hostAllowed || matchHost(c.allowHosts, host)
+		if !hostAllowed && len(c.allowCIDRs) == 0 {
+			return nil, fmt.Errorf("%w: host %s", ErrEgressDenied, host)
+		}
+
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	allowed := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if containsIP(c.denyCIDRs, ip) {
+			continue
+		}
+		if internalIP(ip) && !containsIP(c.allowCIDRs, ip) {
+			continue
+		}
+		if !hostAllowed && !containsIP(c.allowCIDRs, ip) {
+			continue
+		}
+		allowed = append(allowed, ip)
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("%w: host %s", ErrEgressDenied, host)
+	}
+
+	return allowed, nil
+}
+
+// dynamicEndpoint returns the endpoint to dial for a destination requested by
+// remote. The resolved address is dialed so that the checked address is the
+// one used.
+func (t *Tunnel) dynamicEndpoint(dest string) (*Endpoint, error) {
+	if !t.config.DynamicTo {
+		return nil, ErrDynamicToNotAllowed
+	}
+
+	host, portStr, err := net.SplitHostPort(dest)
+	if err != nil {
+		return nil, err
+	}
+	port, err := parsePort(portStr)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("invalid destination %s", dest)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	ips, err := t.egress.allowedIPs(ctx, host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Endpoint{Scheme: SchemeTCP, Address: net.JoinHostPort(ips[0].String(), strconv.Itoa(port))}, nil
+}
@@ -0,0 +1,56 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestEgressPolicy(t *testing.T) {
+	testCases := []struct {
+		name    string
+		policy  *EgressPolicy
+		host    string
+		port    int
+		allowed bool
+	}{
+		{"nil policy public", nil, "8.8.8.8", 53, true},
+		{"nil policy loopback", nil, "127.0.0.1", 22, false},
+		{"nil policy private", nil, "10.1.2.3", 22, false},
+		{"nil policy private 172", nil, "172.16.0.1", 22, false},
+		{"nil policy private 192", nil, "192.168.1.1", 22, false},
+		{"nil policy link local", nil, "169.254.169.254", 80, false},
+		{"nil policy shared", nil, "100.64.0.1", 80, false},
+		{"nil policy unspecified", nil, "0.0.0.0", 80, false},
+		{"nil policy ipv6 loopback", nil, "::1", 22, false},
+		{"nil policy ipv6 unique local", nil, "fd00::1", 22, false},
+		{"nil policy ipv4 mapped loopback", nil, "::ffff:127.0.0.1", 22, false},
+		{"empty policy loopback", &EgressPolicy{}, "127.0.0.1", 22, false},
+		{"allowed cidr private", &EgressPolicy{AllowCIDRs: []string{"10.0.0.0/8"}}, "10.1.2.3", 22, true},
+		{"allowed cidr other", &EgressPolicy{AllowCIDRs: []string{"10.0.0.0/8"}}, "8.8.8.8", 53, false},
+		{"denied cidr", &EgressPolicy{DenyCIDRs: []string{"8.8.8.0/24"}}, "8.8.8.8", 53, false},
+		{"deny over allow", &EgressPolicy{AllowCIDRs: []string{"10.0.0.0/8"}, DenyCIDRs: []string{"10.0.0.1"}}, "10.0.0.1", 22, false},
+		{"allowed port", &EgressPolicy{AllowPorts: []string{"80", "8000-9000"}}, "8.8.8.8", 8080, true},
+		{"denied port", &EgressPolicy{AllowPorts: []string{"80", "8000-9000"}}, "8.8.8.8", 22, false},
+		{"resolved loopback", nil, "localhost", 22, false},
+		{"resolved loopback allowed host", &EgressPolicy{AllowHosts: []string{"localhost"}}, "localhost", 22, false},
+		{"resolved loopback allowed cidr", &EgressPolicy{AllowCIDRs: []string{"127.0.0.0/8", "::1"}}, "localhost", 22, true},
+		{"denied host", &EgressPolicy{DenyHosts: []string{"*.example.com"}}, "www.example.com", 443, false},
+		{"host not allowed", &EgressPolicy{AllowHosts: []string{"*.example.com"}}, "localhost", 22, false},
+	}
+
+	for _, tc := range testCases {
+		c, err := newEgressChecker(tc.policy)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		_, err = c.allowedIPs(context.Background(), tc.host, tc.port)
+		if tc.allowed {
+			if err != nil {
+				t.Fatalf("%s: %s:%d is denied: %v", tc.name, tc.host, tc.port, err)
+			}
+		} else if !errors.Is(err, ErrEgressDenied) {
+			t.Fatalf("%s: %s:%d got err %v, expected %v", tc.name, tc.host, tc.port, err, ErrEgressDenied)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package tunnel
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+)
+
+const (
+	SchemeTCP  = "tcp"
+	SchemeUDP  = "udp"
+	SchemeNKN  = "nkn"
+	SchemeUnix = "unix"
+)
+
+var (
+	ErrInvalidEndpoint       = errors.New("invalid endpoint")
+	ErrTLSServerNameRequired = errors.New("sni or insecure is required for tls over unix socket")
+)
+
+// Endpoint is a parsed tunnel from or to address. It can be written in URI
+// form like "tcp://127.0.0.1:8080?timeout=5s", "udp://[::1]:53",
+// "nkn://identifier.pubkey" and "unix:///var/run/docker.sock", or in the
+// legacy form: empty or "nkn" for listening on NKN, "unix:path" for unix
+// socket, host:port for tcp address and anything else for NKN address.
+//
+// Tcp and udp address can have a port range like "0.0.0.0:40000-40100", and
+// NKN address can have a port or port range like "identifier.pubkey:40000"
+// which is sent to remote to choose the port to dial.
+type Endpoint struct {
+	Scheme  string
+	Address string // host:port, NKN address or unix socket path, without port range.
+
+	// PortMin and PortMax are set if address has a port range, or if NKN
+	// address has a port.
+	PortMin int
+	PortMax int
+
+	// Options set by URI query.
+	DialTimeout time.Duration // Overrides dial timeout in config if not zero.
+
+	// TLS options set by URI query, e.g.
+	// "tcp://0.0.0.0:443?cert=server.crt&key=server.key&ca=clients.crt" for
+	// listening, or "tcp://example.com:443?tls=true&ca=ca.crt" for dialing.
+	// For listening, cert and key are required, and client certificate signed
+	// by ca is required if ca is set. For dialing, ca is used to verify server
+	// certificate instead of system roots, cert and key are used as client
+	// certificate, and server name is the host of address if not set. Any of
+	// these options implies tls.
+	TLS                   bool
+	TLSCert               string
+	TLSKey                string
+	TLSCA                 string
+	TLSServerName         string
+	TLSInsecureSkipVerify bool // Only for test environment.
+
+	// Destination set by "dest" query of NKN address, e.g.
+	// "nkn://pubkey?dest=example.com:443", asks remote to dial it if remote
+	// allows dynamic destination.
+	Destination string
+}
+
+// ParseEndpoint parses a tunnel address into an Endpoint.
+func ParseEndpoint(s string) (*Endpoint, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 || strings.ToLower(s) == SchemeNKN {
+		return &Endpoint{Scheme: SchemeNKN}, nil
+	}
+
+	var e *Endpoint
+	if i := strings.Index(s, "://"); i >= 0 {
+		e = &Endpoint{Scheme: strings.ToLower(s[:i]), Address: s[i+3:]}
+		if j := strings.LastIndex(e.Address, "?"); j >= 0 {
+			query, err := url.ParseQuery(e.Address[j+1:])
+			if err != nil {
+				return nil, fmt.Errorf("%w %s: %v", ErrInvalidEndpoint, s, err)
+			}
+			e.Address = e.Address[:j]
+			err = e.setOptions(query)
+			if err != nil {
+				return nil, fmt.Errorf("%w %s: %v", ErrInvalidEndpoint, s, err)
+			}
+		}
+	} else if strings.HasPrefix(s, SchemeUnix+":") {
+		e = &Endpoint{Scheme: SchemeUnix, Address: strings.TrimPrefix(s, SchemeUnix+":")}
+	} else if host, _, err := net.SplitHostPort(s); err == nil && isNKNAddr(host) {
+		e = &Endpoint{Scheme: SchemeNKN, Address: s}
+	} else if strings.Contains(s, ":") {
+		e = &Endpoint{Scheme: SchemeTCP, Address: s}
+	} else {
+		e = &Endpoint{Scheme: SchemeNKN, Address: s}
+	}
+
+	err := e.parsePortRange()
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %v", ErrInvalidEndpoint, s, err)
+	}
+
+	err = e.validate()
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %v", ErrInvalidEndpoint, s, err)
+	}
+
+	return e, nil
+}
+
+func (e *Endpoint) setOptions(query url.Values) error {
+	for key, values := range query {
+		value := values[len(values)-1]
+		switch key {
+		case "timeout":
+			timeout, err := parseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid timeout %s", value)
+			}
+			e.DialTimeout = timeout
+		case "tls":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid tls %s", value)
+			}
+			e.TLS = b
+		case "cert":
+			e.TLSCert = value
+			e.TLS = true
+		case "key":
+			e.TLSKey = value
+			e.TLS = true
+		case "ca":
+			e.TLSCA = value
+			e.TLS = true
+		case "sni":
+			e.TLSServerName = value
+			e.TLS = true
+		case "insecure":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid insecure %s", value)
+			}
+			e.TLSInsecureSkipVerify = b
+			e.TLS = e.TLS || b
+		case "dest":
+			if _, _, err := net.SplitHostPort(value); err != nil {
+				return fmt.Errorf("invalid dest %s", value)
+			}
+			e.Destination = value
+		default:
+			return fmt.Errorf("unknown option %s", key)
+		}
+	}
+	return nil
+}
+
+// parsePortRange moves port range in address to PortMin and PortMax.
+func (e *Endpoint) parsePortRange() error {
+	var err error
+	switch e.Scheme {
+	case SchemeTCP, SchemeUDP:
+		host, port, err := net.SplitHostPort(e.Address)
+		if err != nil || !strings.Contains(port, "-") {
+			return nil
+		}
+		e.PortMin, e.PortMax, err = parsePortRange(port)
+		if err != nil {
+			return err
+		}
+		e.Address = host
+	case SchemeNKN:
+		i := strings.LastIndex(e.Address, ":")
+		if i < 0 {
+			return nil
+		}
+		e.PortMin, e.PortMax, err = parsePortRange(e.Address[i+1:])
+		if err != nil {
+			return err
+		}
+		e.Address = e.Address[:i]
+	}
+	return nil
+}
+
+func (e *Endpoint) validate() error {
+	if e.HasPortRange() && e.PortMin == 0 {
+		return errors.New("port range should not contain port 0")
+	}
+
+	switch e.Scheme {
+	case SchemeTCP, SchemeUDP:
+		if e.HasPortRange() {
+			break
+		}
+		_, port, err := net.SplitHostPort(e.Address)
+		if err != nil {
+			return err
+		}
+		_, err = net.LookupPort(e.Scheme, port)
+		if err != nil {
+			return err
+		}
+	case SchemeUnix:
+		if len(e.Address) == 0 {
+			return errors.New("empty unix socket path")
+		}
+	case SchemeNKN:
+		if strings.ContainsAny(e.Address, " \t\r\n/") {
+			return fmt.Errorf("invalid NKN address %s", e.Address)
+		}
+	default:
+		return fmt.Errorf("unknown scheme %s", e.Scheme)
+	}
+	if e.TLS && e.Scheme != SchemeTCP && e.Scheme != SchemeUnix {
+		return fmt.Errorf("tls is not supported for scheme %s", e.Scheme)
+	}
+	if len(e.Destination) > 0 && (e.Scheme != SchemeNKN || len(e.Address) == 0) {
+		return errors.New("dest is only supported for dialing NKN address")
+	}
+	if len(e.TLSCert) > 0 != (len(e.TLSKey) > 0) {
+		return errors.New("tls cert and key should be set together")
+	}
+	if e.TLS && e.Scheme == SchemeUnix && len(e.TLSCert) == 0 && len(e.TLSServerName) == 0 && !e.TLSInsecureSkipVerify {
+		// Server name can not be derived from a socket path.
+		return ErrTLSServerNameRequired
+	}
+	return nil
+}
+
+// IsNKN returns whether the endpoint is an NKN address. An NKN endpoint with
+// empty address means listening on NKN.
+func (e *Endpoint) IsNKN() bool {
+	return e.Scheme == SchemeNKN
+}
+
+// HasPortRange returns whether the endpoint has a port range, or a port for
+// NKN endpoint.
+func (e *Endpoint) HasPortRange() bool {
+	return e.PortMax > 0
+}
+
+// PortCount returns the number of ports in port range, or 1 if there is no
+// port range.
+func (e *Endpoint) PortCount() int {
+	if !e.HasPortRange() {
+		return 1
+	}
+	return e.PortMax - e.PortMin + 1
+}
+
+// String returns the endpoint in URI form without options.
+func (e *Endpoint) String() string {
+	if !e.HasPortRange() {
+		return e.Scheme + "://" + e.Address
+	}
+	ports := strconv.Itoa(e.PortMin)
+	if e.PortMax > e.PortMin {
+		ports += "-" + strconv.Itoa(e.PortMax)
+	}
+	if e.IsNKN() {
+		return e.Scheme + "://" + e.Address + ":" + ports
+	}
+	return e.Scheme + "://" + net.JoinHostPort(e.Address, ports)
+}
+
+// withPort returns a copy of the endpoint with a single port in its port
+// range.
+func (e *Endpoint) withPort(port int) *Endpoint {
+	ep := *e
+	if e.IsNKN() {
+		ep.PortMin, ep.PortMax = port, port
+	} else {
+		ep.Address = net.JoinHostPort(e.Address, strconv.Itoa(port))
+		ep.PortMin, ep.PortMax = 0, 0
+	}
+	return &ep
+}
+
+// containsPort returns whether port is in the port range of endpoint.
+func (e *Endpoint) containsPort(port int) bool {
+	return port >= e.PortMin && port <= e.PortMax
+}
+
+// remotePort returns the port sent to remote for NKN endpoint with a single
+// port, or 0 otherwise.
+func (e *Endpoint) remotePort() int {
+	if e.IsNKN() && e.HasPortRange() && e.PortMin == e.PortMax {
+		return e.PortMin
+	}
+	return 0
+}
+
+// network returns the network name used by net package.
+func (e *Endpoint) network() string {
+	return e.Scheme
+}
+
+// dialConfig returns the NKN dial config of this endpoint.
+func (e *Endpoint) dialConfig(config *nkn.DialConfig) *nkn.DialConfig {
+	if e.DialTimeout == 0 {
+		return config
+	}
+	conf := &nkn.DialConfig{}
+	if config != nil {
+		*conf = *config
+	}
+	conf.DialTimeout = int32(e.DialTimeout / time.Millisecond)
+	return conf
+}
+
+// dialTimeout returns the net dial timeout of this endpoint.
+func (e *Endpoint) dialTimeout(config *nkn.DialConfig) time.Duration {
+	if e.DialTimeout > 0 {
+		return e.DialTimeout
+	}
+	if config != nil {
+		return time.Duration(config.DialTimeout) * time.Millisecond
+	}
+	return 0
+}
+
+// parsePortRange parses a port range in the form of "min-max" or a single
+// port.
+func parsePortRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	min, err := parsePort(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	max := min
+	if len(parts) > 1 {
+		max, err = parsePort(parts[1])
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if min > max {
+		return 0, 0, fmt.Errorf("invalid port range %s", s)
+	}
+	return min, max, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || port < 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %s", s)
+	}
+	return port, nil
+}
+
+// isNKNAddr returns whether addr looks like an NKN address, which is a hex
+// encoded public key with optional identifier prefix.
+func isNKNAddr(addr string) bool {
+	pubKey := addr[strings.LastIndex(addr, ".")+1:]
+	if len(pubKey) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(pubKey)
+	return err == nil
+}
+
+// parseDuration parses a duration string, or an integer in milliseconds.
+func parseDuration(s string) (time.Duration, error) {
+	if ms, err := strconv.Atoi(s); err == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// isUDPTunnel returns whether UDP should be forwarded between from and to.
+func isUDPTunnel(config *Config, from, to *Endpoint) bool {
+	return config.UDP || from.Scheme == SchemeUDP || to.Scheme == SchemeUDP
+}
+
+// checkPortRanges checks whether port ranges of from and to can be mapped.
+func checkPortRanges(from, to *Endpoint) error {
+	if from.HasPortRange() && !from.IsNKN() && from.Scheme != SchemeTCP && from.Scheme != SchemeUDP {
+		return fmt.Errorf("%w %s: port range is only supported for tcp and udp", ErrInvalidEndpoint, from)
+	}
+	if from.IsNKN() || !to.HasPortRange() {
+		return nil
+	}
+	if from.PortCount() != to.PortCount() {
+		return fmt.Errorf("%w: port range of %s and %s should have the same size", ErrInvalidEndpoint, from, to)
+	}
+	return nil
+}
+
+// portMappings maps each port of local from endpoint to the corresponding port
+// of to endpoint.
+func portMappings(from, to *Endpoint) []*portMapping {
+	if !from.HasPortRange() {
+		return []*portMapping{{from: from, to: to}}
+	}
+	mappings := make([]*portMapping, 0, from.PortCount())
+	for i := 0; i < from.PortCount(); i++ {
+		m := &portMapping{from: from.withPort(from.PortMin + i), to: to}
+		if to.HasPortRange() {
+			m.to = to.withPort(to.PortMin + i)
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings
+}
+
+// requestedEndpoint returns the endpoint of port requested by remote within
+// the port range of to. Port 0 means no port is requested.
+func requestedEndpoint(to *Endpoint, port int) (*Endpoint, error) {
+	if !to.HasPortRange() || (port == 0 && to.PortCount() == 1) {
+		return to, nil
+	}
+	if !to.containsPort(port) {
+		return nil, fmt.Errorf("port %d is not in range of %s", port, to)
+	}
+	return to.withPort(port), nil
+}
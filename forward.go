@@ -0,0 +1,140 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+const remoteForwardRetryInterval = 5 * time.Second
+
+var (
+	ErrRemoteForwardNotAllowed = errors.New("remote forward is not allowed")
+	ErrRemoteForwardNotFromNKN = errors.New("remote forward requires listening on NKN")
+)
+
+// remoteForward keeps a remote forward registered at the tunnel server until
+// tunnel is closed or the server rejects it.
+func (t *Tunnel) remoteForward() error {
+	for {
+		conn, _, _, err := t.dialNKN(t.config.RemoteForwardAddr, t.config.DialConfig, &handshakeRequest{
+			Type: handshakeTypeRemoteForward,
+			Port: t.config.RemoteForwardPort,
+		})
+		if err == nil {
+			log.Printf("Remote forward port %d at %s", t.config.RemoteForwardPort, t.config.RemoteForwardAddr)
+			_, err = io.Copy(io.Discard, conn)
+			conn.Close()
+		}
+
+		if t.IsClosed() {
+			return nil
+		}
+		if errors.Is(err, ErrHandshakeRejected) {
+			return err
+		}
+
+		log.Println("Remote forward error:", err)
+		time.Sleep(remoteForwardRetryInterval)
+	}
+}
+
+// handleRemoteForward listens at the requested port and dials each accepted
+// connection back to the requester until the control session is closed.
+func (t *Tunnel) handleRemoteForward(ctrlConn net.Conn, req *handshakeRequest) {
+	defer ctrlConn.Close()
+
+	listener, err := t.listenRemoteForward(req.Port)
+	if err != nil {
+		log.Println("Remote forward error:", err)
+		replyHandshake(ctrlConn, nil, err)
+		return
+	}
+	defer listener.Close()
+
+	err = replyHandshake(ctrlConn, nil, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	remoteAddr := ctrlConn.RemoteAddr().String()
+	log.Printf("Remote forward %s to %s", listener.Addr(), remoteAddr)
+
+	go func() {
+		io.Copy(io.Discard, ctrlConn)
+		listener.Close()
+	}()
+
+	for {
+		fromConn, err := listener.Accept()
+		if err != nil {
+			if t.config.Verbose {
+				log.Println("Remote forward", listener.Addr(), "closed:", err)
+			}
+			return
+		}
+		if t.config.Verbose {
+			log.Println("Accept from", fromConn.RemoteAddr())
+		}
+
+		go func(fromConn net.Conn) {
+			toConn, _, mode, err := t.dialNKN(remoteAddr, t.config.DialConfig, &handshakeRequest{Type: handshakeTypeConnect})
+			if err != nil {
+				log.Println(err)
+				fromConn.Close()
+				return
+			}
+			if t.config.Verbose {
+				log.Println("Dial to", toConn.RemoteAddr(), "via", mode)
+			}
+
+			t.pipe(fromConn, toConn, mode)
+		}(fromConn)
+	}
+}
+
+func (t *Tunnel) listenRemoteForward(port int) (net.Listener, error) {
+	if len(t.config.RemoteForwardPorts) == 0 {
+		return nil, ErrRemoteForwardNotAllowed
+	}
+	min, max, err := parsePortRange(t.config.RemoteForwardPorts)
+	if err != nil {
+		return nil, err
+	}
+	if port < min || port > max {
+		return nil, fmt.Errorf("%w: port %d is out of range %s", ErrRemoteForwardNotAllowed, port, t.config.RemoteForwardPorts)
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(t.config.RemoteForwardHost, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.isClosed {
+		listener.Close()
+		return nil, ErrClosed
+	}
+	t.remoteForwardListeners[listener] = struct{}{}
+
+	return &remoteForwardListener{Listener: listener, tunnel: t}, nil
+}
+
+// remoteForwardListener unregisters itself from tunnel on close.
+type remoteForwardListener struct {
+	net.Listener
+	tunnel *Tunnel
+}
+
+func (l *remoteForwardListener) Close() error {
+	l.tunnel.lock.Lock()
+	delete(l.tunnel.remoteForwardListeners, l.Listener)
+	l.tunnel.lock.Unlock()
+	return l.Listener.Close()
+}
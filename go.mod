@@ -1,6 +1,6 @@
 module github.com/nknorg/nkn-tunnel
 
-go 1.20
+go 1.22.0
 
 require (
 	dario.cat/mergo v1.0.1
@@ -11,7 +11,8 @@ require (
 	github.com/nknorg/nkn/v2 v2.2.1
 	github.com/nknorg/nkngomobile v0.0.0-20220615081414-671ad1afdfa9
 	github.com/nknorg/tuna v0.1.0
-	github.com/patrickmn/go-cache v2.1.0+incompatible
+	github.com/xtaci/smux v2.0.1+incompatible
+	golang.org/x/term v0.26.0
 )
 
 require (
@@ -25,6 +26,7 @@ require (
 	github.com/nknorg/encrypted-stream v1.0.2-0.20230320101720-9891f770de86 // indirect
 	github.com/oschwald/geoip2-golang v1.11.0 // indirect
 	github.com/oschwald/maxminddb-golang v1.13.1 // indirect
+	github.com/patrickmn/go-cache v2.1.0+incompatible // indirect
 	github.com/pbnjay/memory v0.0.0-20210728143218-7b4eea64cf58 // indirect
 	github.com/pborman/uuid v1.2.1 // indirect
 	github.com/pion/datachannel v1.5.9 // indirect
@@ -46,7 +48,6 @@ require (
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/rdegges/go-ipify v0.0.0-20150526035502-2d94a6a86c40 // indirect
 	github.com/wlynxg/anet v0.0.5 // indirect
-	github.com/xtaci/smux v2.0.1+incompatible // indirect
 	golang.org/x/crypto v0.29.0 // indirect
 	golang.org/x/mobile v0.0.0-20241108191957-fa514ef75a0f // indirect
 	golang.org/x/net v0.31.0 // indirect
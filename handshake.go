@@ -0,0 +1,310 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Handshake is a length prefixed JSON message exchanged at the beginning of a
+// session when handshake is enabled. Incoming sessions not starting with the
+// magic within handshakeDetectTimeout are plain sessions from remotes without
+// handshake. Upstream is dialed while detecting, and sessions are plain as
+// soon as upstream sends data first, so that protocols in which the server
+// speaks first are not stalled.
+const (
+	handshakeMagic         = "NKNT"
+	handshakeVersion       = 1
+	maxHandshakeSize       = 64 << 10
+	handshakeTimeout       = 30 * time.Second
+	handshakeDetectTimeout = 5 * time.Second
+	earlyReadSize          = 32 << 10
+)
+
+const (
+	handshakeTypeConnect       = "connect"
+	handshakeTypeRemoteForward = "remote-forward"
+	handshakeTypeUDP           = "udp"
+	handshakeTypeMux           = "mux"
+	handshakeTypePing          = "ping"
+)
+
+var (
+	ErrInvalidHandshake  = errors.New("invalid handshake")
+	ErrHandshakeRejected = errors.New("handshake rejected by remote")
+	ErrHandshakeRequired = errors.New("handshake is required")
+)
+
+type handshakeRequest struct {
+	Type string `json:"type"`
+	Port int    `json:"port,omitempty"`
+	// Destination is the host:port requested to dial if remote allows
+	// dynamic destination.
+	Destination string `json:"destination,omitempty"`
+	// Compression is the compression algorithms offered in preference order.
+	Compression []string `json:"compression,omitempty"`
+}
+
+type handshakeResponse struct {
+	Error string `json:"error,omitempty"`
+	// Compression is the compression algorithm chosen from the offered ones,
+	// or empty for no compression.
+	Compression string `json:"compression,omitempty"`
+}
+
+func writeHandshake(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(b) > maxHandshakeSize {
+		return ErrInvalidHandshake
+	}
+
+	buf := make([]byte, len(handshakeMagic)+1+4+len(b))
+	n := copy(buf, handshakeMagic)
+	buf[n] = handshakeVersion
+	binary.BigEndian.PutUint32(buf[n+1:], uint32(len(b)))
+	copy(buf[n+5:], b)
+
+	_, err = w.Write(buf)
+	return err
+}
+
+func readHandshake(r io.Reader, v interface{}) error {
+	magic := make([]byte, len(handshakeMagic))
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return err
+	}
+	if string(magic) != handshakeMagic {
+		return ErrInvalidHandshake
+	}
+	return readHandshakeBody(r, v)
+}
+
+// readHandshakeBody reads the rest of a handshake after its magic.
+func readHandshakeBody(r io.Reader, v interface{}) error {
+	header := make([]byte, 1+4)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return err
+	}
+
+	if header[0] != handshakeVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidHandshake, header[0])
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxHandshakeSize {
+		return ErrInvalidHandshake
+	}
+
+	b := make([]byte, size)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidHandshake, err)
+	}
+	return nil
+}
+
+// acceptHandshake reads the handshake request of an incoming session if it
+// starts with handshake magic. Otherwise it returns a nil request and conn
+// that reads from the beginning of the session, which should be handled as a
+// plain session. If early is not nil, the session is plain as soon as its
+// upstream sends data before remote does.
+func acceptHandshake(conn net.Conn, early *earlyDial) (net.Conn, *handshakeRequest, error) {
+	peeked := newReadAheadConn(conn, func() ([]byte, error) {
+		return peekHandshakeMagic(conn)
+	})
+	var spoke <-chan struct{}
+	if early != nil {
+		spoke = early.spoke
+	}
+	select {
+	case <-peeked.done:
+	case <-spoke:
+		return peeked, nil, nil
+	}
+
+	magic, err := peeked.readAhead()
+	if err != nil {
+		return nil, nil, err
+	}
+	if string(magic) != handshakeMagic {
+		return peeked, nil, nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	req := &handshakeRequest{}
+	err = readHandshakeBody(conn, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, req, nil
+}
+
+// peekHandshakeMagic reads from conn until it has read handshake magic, data
+// that can't be handshake magic, or nothing more within
+// handshakeDetectTimeout, and returns the data read.
+func peekHandshakeMagic(conn net.Conn) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(handshakeDetectTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	b := make([]byte, len(handshakeMagic))
+	n := 0
+	for n < len(b) && string(b[:n]) == handshakeMagic[:n] {
+		m, err := conn.Read(b[n:])
+		n += m
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			if n == 0 {
+				return nil, err
+			}
+			break
+		}
+	}
+	return b[:n], nil
+}
+
+// readAheadConn reads from conn by read in the background once created, and
+// returns the data of it before reading from conn, or its error afterwards.
+type readAheadConn struct {
+	net.Conn
+	done chan struct{}
+	buf  []byte
+	err  error
+	off  int
+}
+
+func newReadAheadConn(conn net.Conn, read func() ([]byte, error)) *readAheadConn {
+	c := &readAheadConn{Conn: conn, done: make(chan struct{})}
+	go func() {
+		c.buf, c.err = read()
+		close(c.done)
+	}()
+	return c
+}
+
+// readAhead waits for the read ahead, and returns its data and error.
+func (c *readAheadConn) readAhead() ([]byte, error) {
+	<-c.done
+	return c.buf, c.err
+}
+
+func (c *readAheadConn) Read(b []byte) (int, error) {
+	<-c.done
+	if c.off < len(c.buf) {
+		n := copy(b, c.buf[c.off:])
+		c.off += n
+		return n, nil
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+// earlyDial is the upstream conn dialed while detecting the handshake of an
+// incoming session. Spoke is closed if upstream sends data before remote.
+type earlyDial struct {
+	to     *Endpoint
+	dialed chan struct{}
+	spoke  chan struct{}
+	conn   net.Conn
+	mode   string
+	err    error
+	taken  bool
+}
+
+// dialEarly dials to in the background, and starts reading from it.
+func (t *Tunnel) dialEarly(to *Endpoint) *earlyDial {
+	d := &earlyDial{to: to, dialed: make(chan struct{}), spoke: make(chan struct{})}
+	go func() {
+		conn, mode, err := t.dial(to)
+		if err == nil {
+			c := newReadAheadConn(conn, func() ([]byte, error) {
+				b := make([]byte, earlyReadSize)
+				n, err := conn.Read(b)
+				return b[:n], err
+			})
+			go func() {
+				if b, _ := c.readAhead(); len(b) > 0 {
+					close(d.spoke)
+				}
+			}()
+			d.conn = c
+		}
+		d.mode, d.err = mode, err
+		close(d.dialed)
+	}()
+	return d
+}
+
+// get waits for the dial and returns its result.
+func (d *earlyDial) get() (net.Conn, string, error) {
+	d.taken = true
+	<-d.dialed
+	return d.conn, d.mode, d.err
+}
+
+// discard closes the dialed conn once dialed unless it's taken by get.
+func (d *earlyDial) discard() {
+	if d == nil || d.taken {
+		return
+	}
+	d.taken = true
+	go func() {
+		<-d.dialed
+		if d.conn != nil {
+			d.conn.Close()
+		}
+	}()
+}
+
+// replyHandshake sends the handshake response of an incoming session. A non
+// nil err is sent to remote as a rejection.
+func replyHandshake(conn net.Conn, resp *handshakeResponse, err error) error {
+	if resp == nil {
+		resp = &handshakeResponse{}
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return writeHandshake(conn, resp)
+}
+
+// dialHandshake sends the handshake request on a dialed session and waits for
+// the response.
+func dialHandshake(conn net.Conn, req *handshakeRequest) (*handshakeResponse, error) {
+	err := writeHandshake(conn, req)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	resp := &handshakeResponse{}
+	err = readHandshake(conn, resp)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Error) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrHandshakeRejected, resp.Error)
+	}
+	return resp, nil
+}
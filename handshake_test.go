@@ -0,0 +1,104 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAcceptHandshake(t *testing.T) {
+	testCases := []struct {
+		name      string
+		data      []byte
+		handshake bool
+	}{
+		{"plain", []byte("GET / HTTP/1.1\r\n\r\n"), false},
+		{"plain with magic prefix", []byte("NKNX plain"), false},
+		{"handshake", nil, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			local, remote := net.Pipe()
+			defer local.Close()
+			defer remote.Close()
+
+			go func() {
+				if tc.handshake {
+					writeHandshake(remote, &handshakeRequest{Type: handshakeTypeConnect, Port: 8080})
+				} else {
+					remote.Write(tc.data)
+				}
+			}()
+
+			conn, req, err := acceptHandshake(local, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.handshake {
+				if req == nil || req.Type != handshakeTypeConnect || req.Port != 8080 {
+					t.Fatalf("got request %+v", req)
+				}
+				return
+			}
+			if req != nil {
+				t.Fatalf("plain session got request %+v", req)
+			}
+			b := make([]byte, len(tc.data))
+			if _, err = io.ReadFull(conn, b); err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != string(tc.data) {
+				t.Fatalf("plain session got %q, expected %q", b, tc.data)
+			}
+		})
+	}
+}
+
+func TestHandshakeServerSpeaksFirst(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("220 ready\r\n"))
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+
+	to, err := ParseEndpoint(upstream.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun := &Tunnel{fromNKN: true, config: &Config{Handshake: true}, conns: make(map[uint64]*trackedConn)}
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go tun.handleConn(local, to, "")
+
+	remote.SetReadDeadline(time.Now().Add(handshakeDetectTimeout / 2))
+	b := make([]byte, len("220 ready\r\n"))
+	if _, err = io.ReadFull(remote, b); err != nil {
+		t.Fatal("banner is not received before handshake detect timeout:", err)
+	}
+	if string(b) != "220 ready\r\n" {
+		t.Fatalf("got %q", b)
+	}
+
+	remote.SetReadDeadline(time.Now().Add(handshakeDetectTimeout))
+	if _, err = remote.Write([]byte("NKNT")); err != nil {
+		t.Fatal(err)
+	}
+	b = make([]byte, 4)
+	if _, err = io.ReadFull(remote, b); err != nil || string(b) != "NKNT" {
+		t.Fatalf("got %q, %v after banner", b, err)
+	}
+}
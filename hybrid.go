@@ -0,0 +1,158 @@
+package tunnel
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/nknorg/ncp-go"
+	"github.com/nknorg/nkn-sdk-go"
+	ts "github.com/nknorg/nkn-tuna-session"
+)
+
+// Dial modes of a tunnel using tuna.
+const (
+	// TunaDialModeTuna dials tuna sessions only.
+	TunaDialModeTuna = "tuna"
+	// TunaDialModeFallback dials tuna session first, and NKN session if tuna
+	// fails or is not established within TunaFallbackTimeout.
+	TunaDialModeFallback = "fallback"
+	// TunaDialModeRace dials NKN session TunaRaceDelay after tuna session,
+	// and uses whichever is established first.
+	TunaDialModeRace = "race"
+)
+
+var (
+	ErrUnknownTunaDialMode = errors.New("unknown tuna dial mode")
+)
+
+func checkTunaDialMode(mode string) error {
+	switch mode {
+	case "", TunaDialModeTuna, TunaDialModeFallback, TunaDialModeRace:
+		return nil
+	default:
+		return ErrUnknownTunaDialMode
+	}
+}
+
+func (m *multiClientDialer) dialSession(addr string, config *nkn.DialConfig) (*ncp.Session, string, error) {
+	sess, err := m.DialWithConfig(addr, config)
+	return sess, ModeNKN, err
+}
+
+func (d *tunaSessionDialer) dialSession(addr string, config *nkn.DialConfig) (*ncp.Session, string, error) {
+	sess, err := d.DialWithConfig(addr, config)
+	return sess, ModeTuna, err
+}
+
+// hybridDialer dials tuna session with NKN session as fallback. NKN session
+// is dialed after delay or once tuna fails, and the session established
+// first is used while the other one is closed. Negative delay dials NKN
+// session only after tuna fails.
+type hybridDialer struct {
+	*tunaSessionDialer
+	nkn   *multiClientDialer
+	delay time.Duration
+}
+
+func newHybridDialer(tuna *tunaSessionDialer, nkn *multiClientDialer, config *Config) *hybridDialer {
+	d := &hybridDialer{tunaSessionDialer: tuna, nkn: nkn}
+	switch config.TunaDialMode {
+	case TunaDialModeFallback:
+		d.delay = time.Duration(config.TunaFallbackTimeout) * time.Millisecond
+		if d.delay <= 0 {
+			d.delay = -1
+		}
+	case TunaDialModeRace:
+		d.delay = time.Duration(config.TunaRaceDelay) * time.Millisecond
+	}
+	return d
+}
+
+type dialResult struct {
+	sess *ncp.Session
+	mode string
+	err  error
+}
+
+func (d *hybridDialer) DialWithConfig(addr string, config *nkn.DialConfig) (*ncp.Session, error) {
+	sess, _, err := d.dialSession(addr, config)
+	return sess, err
+}
+
+func (d *hybridDialer) dialSession(addr string, config *nkn.DialConfig) (*ncp.Session, string, error) {
+	results := make(chan *dialResult, 2)
+	dial := func(dialer interface {
+		dialSession(string, *nkn.DialConfig) (*ncp.Session, string, error)
+	}) {
+		sess, mode, err := dialer.dialSession(addr, config)
+		results <- &dialResult{sess: sess, mode: mode, err: err}
+	}
+
+	go dial(d.tunaSessionDialer)
+
+	var timer <-chan time.Time
+	if d.delay >= 0 {
+		timer = time.After(d.delay)
+	}
+	dialing, nknDialed := 1, false
+	var errs error
+	for dialing > 0 {
+		select {
+		case <-timer:
+			timer = nil
+			if !nknDialed {
+				nknDialed = true
+				dialing++
+				go dial(d.nkn)
+			}
+		case r := <-results:
+			dialing--
+			if r.err == nil {
+				// Close the session established later.
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if r := <-results; r.err == nil {
+							r.sess.Close()
+						}
+					}
+				}(dialing)
+				return r.sess, r.mode, nil
+			}
+			errs = multierror.Append(errs, r.err)
+			if r.mode == ModeTuna && !nknDialed {
+				log.Println("Dial tuna session error, fall back to NKN session:", r.err)
+				nknDialed = true
+				dialing++
+				go dial(d.nkn)
+			}
+		}
+	}
+	return nil, "", errs
+}
+
+// DialUDPWithConfig dials tuna UDP, and falls back to UDP over NKN session if
+// it fails and handshake is enabled.
+func (d *hybridDialer) DialUDPWithConfig(remoteAddr string, config *nkn.DialConfig) (udpConn, error) {
+	conn, err := d.tunaSessionDialer.DialUDPWithConfig(remoteAddr, config)
+	if err == nil || !d.config.Handshake {
+		return conn, err
+	}
+	log.Println("Dial tuna UDP error, fall back to NKN session:", err)
+	return d.nkn.DialUDPWithConfig(remoteAddr, config)
+}
+
+// listenerMode returns the mode of sessions accepted by listener, or empty if
+// it's not an NKN listener.
+func listenerMode(listener net.Listener) string {
+	switch listener.(type) {
+	case *nkn.MultiClient:
+		return ModeNKN
+	case *ts.TunaSessionClient:
+		return ModeTuna
+	default:
+		return ""
+	}
+}
@@ -6,6 +6,9 @@ package main
 import "C"
 import (
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/nknorg/ncp-go"
 	"github.com/nknorg/nkn-sdk-go"
 	ts "github.com/nknorg/nkn-tuna-session"
@@ -15,12 +18,30 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"unsafe"
 )
 
+// apiVersion is the version of exported functions, which is increased when
+// they change incompatibly or new ones are added. Version 1 is the single
+// tunnel API of StartNknTunnel and CloseNknTunnel, and version 2 adds handle
+// based tunnel instances.
+const apiVersion = 2
+
 var (
-	instanceTunnel *tunnel.Tunnel
-	tunnelMutex    sync.Mutex
-	logMutex       sync.Mutex
+	Version string
+
+	instances      = make(map[int64]*tunnelInstance)
+	nextHandle     int64
+	instancesMutex sync.Mutex
+
+	// defaultHandle is the handle of the tunnel started by StartNknTunnel.
+	defaultHandle      C.longlong
+	defaultHandleMutex sync.Mutex
+
+	logMutex sync.Mutex
+
+	lastError      string
+	lastErrorMutex sync.Mutex
 
 	logFilePath string
 	logFile     *os.File
@@ -74,21 +95,105 @@ func SetLogFilePath(path *C.char) {
 	initLogger()
 }
 
-//export StartNknTunnel
-func StartNknTunnel(numClients C.int, seedRpcServers *C.char, seedHex *C.char, identifier *C.char,
-	from *C.char, to *C.char, udp C.int, useTuna C.int,
-	tunaMaxPrice *C.char, tunaMinFee *C.char, tunaFeeRatio C.float,
-	tunaDownloadGeoDB C.int, tunaGeoDBPath *C.char, tunaMeasureBandwidth C.int, tunaMeasureStoragePath *C.char, tunaMeasurementBytesDownLink C.int,
-	verbose C.int) C.int {
-	tunnelMutex.Lock()
-	defer tunnelMutex.Unlock()
+// Error codes returned by exported functions. CreateNknTunnel returns them
+// negated, as positive values are tunnel handles.
+const (
+	errNoTunnel      = -1
+	errEmptySeed     = 1
+	errInvalidSeed   = 2
+	errCreateAccount = 3
+	errCreateTunnel  = 4
+	errTunnelStarted = 5
+	errInvalidConfig = 6
+	errTunnelClosed  = 7
+	errInternal      = 8
+)
 
-	if instanceTunnel != nil {
-		log.Println("Closing existing tunnel before starting a new one...")
-		instanceTunnel.Close()
-		instanceTunnel = nil
+var errEmptySeedHex = errors.New("seed hex cannot be empty")
+
+// fail logs err and records it as the last error of the process, and returns
+// code.
+func fail(code C.int, err error) C.int {
+	log.Println(err)
+	lastErrorMutex.Lock()
+	lastError = err.Error()
+	lastErrorMutex.Unlock()
+	return code
+}
+
+func newAccount(seedHex string) (*nkn.Account, C.int) {
+	if seedHex == "" {
+		return nil, fail(errEmptySeed, errEmptySeedHex)
+	}
+	seed, err := hex.DecodeString(seedHex)
+	if err != nil {
+		return nil, fail(errInvalidSeed, fmt.Errorf("invalid seed hex: %w", err))
 	}
+	account, err := nkn.NewAccount(seed)
+	if err != nil {
+		return nil, fail(errCreateAccount, fmt.Errorf("failed to create account: %w", err))
+	}
+	return account, 0
+}
+
+// tunnelInstance is a tunnel created by CreateNknTunnel with its own config.
+// The tunnel is created on start, so that an instance can be started again
+// after being closed. Tunnels are created without lock as it waits for NKN
+// clients to connect, and closing the instance meanwhile cancels the start.
+type tunnelInstance struct {
+	account    *nkn.Account
+	identifier string
+	from       []string
+	to         []string
+	useTuna    bool
+	config     *tunnel.Config
 
+	lock     sync.Mutex
+	tunnels  []*tunnel.Tunnel
+	starting bool
+	canceled bool
+	err      string
+	lastErr  string
+}
+
+// fail is fail that also records err as the last error of the instance.
+func (ti *tunnelInstance) fail(code C.int, err error) C.int {
+	ti.lock.Lock()
+	ti.lastErr = err.Error()
+	ti.lock.Unlock()
+	return fail(code, err)
+}
+
+func (ti *tunnelInstance) lastError() string {
+	ti.lock.Lock()
+	defer ti.lock.Unlock()
+	return ti.lastErr
+}
+
+// States of a tunnel instance.
+const (
+	instanceStateConnecting = "connecting"
+	instanceStateStarted    = "started"
+	instanceStateClosed     = "closed"
+)
+
+// instanceStatus is the status of a tunnel instance returned by
+// GetNknTunnelStatus.
+type instanceStatus struct {
+	// State is connecting while tunnels are created and NKN clients connect,
+	// started once tunnels are created, and closed otherwise.
+	State   string `json:"state"`
+	Started bool   `json:"started"`
+	// Error is the last error of starting tunnels or tunnels failing.
+	Error   string                 `json:"error,omitempty"`
+	Tunnels []*tunnel.TunnelStatus `json:"tunnels"`
+}
+
+func newTunnelInstance(numClients C.int, seedRpcServers *C.char, seedHex *C.char, identifier *C.char,
+	from *C.char, to *C.char, udp C.int, useTuna C.int,
+	tunaMaxPrice *C.char, tunaMinFee *C.char, tunaFeeRatio C.float,
+	tunaDownloadGeoDB C.int, tunaGeoDBPath *C.char, tunaMeasureBandwidth C.int, tunaMeasureStoragePath *C.char, tunaMeasurementBytesDownLink C.int,
+	verbose C.int) (*tunnelInstance, C.int) {
 	numClientsGo := int(numClients)
 	seedRpcServersGo := C.GoString(seedRpcServers)
 	seedHexGo := C.GoString(seedHex)
@@ -107,9 +212,9 @@ func StartNknTunnel(numClients C.int, seedRpcServers *C.char, seedHex *C.char, i
 	tunaMeasurementBytesDownLinkGo := int32(tunaMeasurementBytesDownLink)
 	verboseGo := verbose != 0
 
-	if seedHexGo == "" {
-		log.Println("Seed hex cannot be empty")
-		return 1
+	account, code := newAccount(seedHexGo)
+	if account == nil {
+		return nil, code
 	}
 
 	if tunaMeasurementBytesDownLinkGo == 0 {
@@ -129,19 +234,6 @@ func StartNknTunnel(numClients C.int, seedRpcServers *C.char, seedHex *C.char, i
 	seedRpcServerList := strings.Split(seedRpcServersGo, ",")
 	seedRpcServerAddr := nkngomobile.NewStringArray(seedRpcServerList...)
 
-	var seed []byte
-	var err error
-
-	seed, err = hex.DecodeString(seedHexGo)
-	if err != nil {
-		log.Println("Invalid seed hex: ", err)
-		return 2
-	}
-	account, err := nkn.NewAccount(seed)
-	if err != nil {
-		log.Println("Failed to create account:", err)
-		return 3
-	}
 	clientConfig := &nkn.ClientConfig{
 		SeedRPCServerAddr: seedRpcServerAddr,
 	}
@@ -176,39 +268,491 @@ func StartNknTunnel(numClients C.int, seedRpcServers *C.char, seedHex *C.char, i
 		UDP:               udpGo,
 		Verbose:           verboseGo,
 	}
-	t, err := tunnel.NewTunnel(account, identifierGo, fromGo, toGo, useTunaGo, config, nil)
-	if err != nil {
-		log.Println("Failed to create tunnel:", err)
-		return 4
+
+	return &tunnelInstance{
+		account:    account,
+		identifier: identifierGo,
+		from:       []string{fromGo},
+		to:         []string{toGo},
+		useTuna:    useTunaGo,
+		config:     config,
+	}, 0
+}
+
+// start creates the tunnels of mappings and starts them in background.
+func (ti *tunnelInstance) start() C.int {
+	ti.lock.Lock()
+	if ti.tunnels != nil || ti.starting {
+		ti.lock.Unlock()
+		return ti.fail(errTunnelStarted, errors.New("tunnel is already started"))
 	}
+	ti.starting = true
+	ti.canceled = false
+	ti.err = ""
+	config := *ti.config
+	ti.lock.Unlock()
 
-	instanceTunnel = t
+	tunnels, err := tunnel.NewTunnels(ti.account, ti.identifier, ti.from, ti.to, ti.useTuna, &config, nil)
 
-	go func() {
-		if err := t.Start(); err != nil {
-			log.Println("Tunnel failed to start:", err)
+	ti.lock.Lock()
+	ti.starting = false
+	if err != nil {
+		err = fmt.Errorf("failed to create tunnel: %w", err)
+		ti.err = err.Error()
+		ti.lock.Unlock()
+		return ti.fail(errCreateTunnel, err)
+	}
+	if ti.canceled {
+		ti.lock.Unlock()
+		for _, t := range tunnels {
+			t.Close()
+		}
+		return ti.fail(errTunnelClosed, errors.New("tunnel is closed while starting"))
+	}
+	if ti.config.AcceptAddrs != config.AcceptAddrs {
+		for _, t := range tunnels {
+			if err := t.SetAcceptAddrs(ti.config.AcceptAddrs); err != nil {
+				log.Println("Set accept addresses error:", err)
+			}
 		}
-	}()
+	}
+	ti.tunnels = tunnels
+	ti.lock.Unlock()
+
+	for _, t := range tunnels {
+		go func(t *tunnel.Tunnel) {
+			if err := t.Start(); err != nil {
+				log.Println("Tunnel failed to start:", err)
+				ti.lock.Lock()
+				ti.err = err.Error()
+				ti.lock.Unlock()
+			}
+		}(t)
+	}
 	log.Println("Tunnel started successfully")
 	return 0
 }
 
-//export CloseNknTunnel
-func CloseNknTunnel() C.int {
-	tunnelMutex.Lock()
-	defer tunnelMutex.Unlock()
-
-	if instanceTunnel == nil {
-		log.Println("No tunnel to close")
-		return -1
+// close closes the tunnels if they are started, or cancels starting them.
+func (ti *tunnelInstance) close() C.int {
+	ti.lock.Lock()
+	if ti.starting {
+		ti.canceled = true
+		ti.lock.Unlock()
+		log.Println("Tunnel is closed while starting")
+		return 0
 	}
+	tunnels := ti.tunnels
+	ti.tunnels = nil
+	ti.lock.Unlock()
 
-	instanceTunnel.Close()
-	instanceTunnel = nil
+	if tunnels == nil {
+		return ti.fail(errNoTunnel, errors.New("no tunnel to close"))
+	}
+	for _, t := range tunnels {
+		t.Close()
+	}
 	log.Println("Tunnel closed successfully")
 	return 0
 }
 
+// status returns the status of the instance and its tunnels.
+func (ti *tunnelInstance) status() *instanceStatus {
+	ti.lock.Lock()
+	defer ti.lock.Unlock()
+
+	s := &instanceStatus{
+		State:   instanceStateClosed,
+		Started: ti.tunnels != nil,
+		Error:   ti.err,
+		Tunnels: make([]*tunnel.TunnelStatus, 0, len(ti.tunnels)),
+	}
+	if ti.starting {
+		s.State = instanceStateConnecting
+	} else if ti.tunnels != nil {
+		s.State = instanceStateStarted
+	}
+	for _, t := range ti.tunnels {
+		s.Tunnels = append(s.Tunnels, t.Status())
+	}
+	return s
+}
+
+// setAcceptAddrs sets accept addresses of started tunnels, and of tunnels
+// started later.
+func (ti *tunnelInstance) setAcceptAddrs(addrs []string) error {
+	ti.lock.Lock()
+	defer ti.lock.Unlock()
+
+	var addrsRe *nkngomobile.StringArray
+	if len(addrs) > 0 {
+		addrsRe = nkngomobile.NewStringArray(addrs...)
+	}
+	for _, t := range ti.tunnels {
+		if err := t.SetAcceptAddrs(addrsRe); err != nil {
+			return err
+		}
+	}
+	ti.config.AcceptAddrs = addrsRe
+	return nil
+}
+
+func addInstance(ti *tunnelInstance) C.longlong {
+	instancesMutex.Lock()
+	defer instancesMutex.Unlock()
+
+	nextHandle++
+	instances[nextHandle] = ti
+	return C.longlong(nextHandle)
+}
+
+func getInstance(handle C.longlong) *tunnelInstance {
+	instancesMutex.Lock()
+	defer instancesMutex.Unlock()
+
+	return instances[int64(handle)]
+}
+
+// getInstanceOrDefault is getInstance, but returns the tunnel started by
+// StartNknTunnel if handle is 0.
+func getInstanceOrDefault(handle C.longlong) *tunnelInstance {
+	if handle == 0 {
+		defaultHandleMutex.Lock()
+		handle = defaultHandle
+		defaultHandleMutex.Unlock()
+	}
+	return getInstance(handle)
+}
+
+func removeInstance(handle C.longlong) *tunnelInstance {
+	instancesMutex.Lock()
+	defer instancesMutex.Unlock()
+
+	ti := instances[int64(handle)]
+	delete(instances, int64(handle))
+	return ti
+}
+
+// CreateNknTunnel creates a tunnel instance with its own config without
+// starting it. Returns a positive handle of the instance for other functions,
+// or a negative error code.
+//
+//export CreateNknTunnel
+func CreateNknTunnel(numClients C.int, seedRpcServers *C.char, seedHex *C.char, identifier *C.char,
+	from *C.char, to *C.char, udp C.int, useTuna C.int,
+	tunaMaxPrice *C.char, tunaMinFee *C.char, tunaFeeRatio C.float,
+	tunaDownloadGeoDB C.int, tunaGeoDBPath *C.char, tunaMeasureBandwidth C.int, tunaMeasureStoragePath *C.char, tunaMeasurementBytesDownLink C.int,
+	verbose C.int) C.longlong {
+	ti, code := newTunnelInstance(numClients, seedRpcServers, seedHex, identifier, from, to, udp, useTuna,
+		tunaMaxPrice, tunaMinFee, tunaFeeRatio, tunaDownloadGeoDB, tunaGeoDBPath, tunaMeasureBandwidth,
+		tunaMeasureStoragePath, tunaMeasurementBytesDownLink, verbose)
+	if ti == nil {
+		return -C.longlong(code)
+	}
+	return addInstance(ti)
+}
+
+// StartNknTunnelHandle starts the tunnel instance of handle. A closed
+// instance can be started again.
+//
+//export StartNknTunnelHandle
+func StartNknTunnelHandle(handle C.longlong) C.int {
+	ti := getInstance(handle)
+	if ti == nil {
+		return fail(errNoTunnel, fmt.Errorf("no tunnel of handle %d", handle))
+	}
+	return ti.start()
+}
+
+// CloseNknTunnelHandle closes the tunnel instance of handle, which can be
+// started again until it's freed. Closing an instance while it's starting
+// cancels the start.
+//
+//export CloseNknTunnelHandle
+func CloseNknTunnelHandle(handle C.longlong) C.int {
+	ti := getInstance(handle)
+	if ti == nil {
+		return fail(errNoTunnel, fmt.Errorf("no tunnel of handle %d", handle))
+	}
+	return ti.close()
+}
+
+// FreeNknTunnel closes the tunnel instance of handle if it's started, and
+// releases the handle.
+//
+//export FreeNknTunnel
+func FreeNknTunnel(handle C.longlong) C.int {
+	ti := removeInstance(handle)
+	if ti == nil {
+		return fail(errNoTunnel, fmt.Errorf("no tunnel of handle %d", handle))
+	}
+	ti.close()
+	return 0
+}
+
+// jsonMapping is a tunnel from a listening address to a dialing address.
+type jsonMapping struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// jsonConfig is the JSON config of CreateNknTunnelWithConfig. Fields of
+// tunnel.Config are accepted with their Go names, e.g. "NumSubClients" or
+// "numSubClients", except string arrays which are replaced by string lists.
+type jsonConfig struct {
+	Seed       string        `json:"seed"`
+	Identifier string        `json:"identifier"`
+	Tuna       bool          `json:"tuna"`
+	Mappings   []jsonMapping `json:"mappings"`
+	// SeedRPCServerAddr is used by both client and wallet.
+	SeedRPCServerAddr []string `json:"seedRpcServerAddr"`
+
+	tunnel.Config
+	AcceptAddrs []string `json:"acceptAddrs"`
+}
+
+// parseJSONConfig parses the JSON config of CreateNknTunnelWithConfig into a
+// tunnel instance.
+func parseJSONConfig(s string) (*tunnelInstance, C.int) {
+	var jc jsonConfig
+	err := json.Unmarshal([]byte(s), &jc)
+	if err != nil {
+		return nil, fail(errInvalidConfig, fmt.Errorf("invalid config: %w", err))
+	}
+	if len(jc.Mappings) == 0 {
+		return nil, fail(errInvalidConfig, errors.New("invalid config: mappings are empty"))
+	}
+
+	account, code := newAccount(jc.Seed)
+	if account == nil {
+		return nil, code
+	}
+
+	config := jc.Config
+	if len(jc.AcceptAddrs) > 0 {
+		config.AcceptAddrs = nkngomobile.NewStringArray(jc.AcceptAddrs...)
+	}
+	if len(jc.SeedRPCServerAddr) > 0 {
+		seedRPCServerAddr := nkngomobile.NewStringArray(jc.SeedRPCServerAddr...)
+		if config.ClientConfig == nil {
+			config.ClientConfig = &nkn.ClientConfig{}
+		}
+		config.ClientConfig.SeedRPCServerAddr = seedRPCServerAddr
+		if config.WalletConfig == nil {
+			config.WalletConfig = &nkn.WalletConfig{}
+		}
+		config.WalletConfig.SeedRPCServerAddr = seedRPCServerAddr
+	}
+	if jc.Tuna {
+		if config.TunaSessionConfig == nil {
+			config.TunaSessionConfig = &ts.Config{}
+		}
+		if config.TunaSessionConfig.TunaMaxPrice == "" {
+			config.TunaSessionConfig.TunaMaxPrice = DefaultTunaMaxPrice
+		}
+		if config.TunaSessionConfig.TunaMinNanoPayFee == "" {
+			config.TunaSessionConfig.TunaMinNanoPayFee = DefaultTunaMinFee
+		}
+		if config.TunaSessionConfig.TunaNanoPayFeeRatio == 0 {
+			config.TunaSessionConfig.TunaNanoPayFeeRatio = DefaultTunaFeeRatio
+		}
+	}
+
+	ti := &tunnelInstance{
+		account:    account,
+		identifier: jc.Identifier,
+		useTuna:    jc.Tuna,
+		config:     &config,
+	}
+	for _, m := range jc.Mappings {
+		ti.from = append(ti.from, m.From)
+		ti.to = append(ti.to, m.To)
+	}
+	return ti, 0
+}
+
+// CreateNknTunnelWithConfig creates a tunnel instance by JSON config without
+// starting it, e.g.
+//
+//	{
+//	  "seed": "<seed hex>",
+//	  "tuna": true,
+//	  "mappings": [{"from": "127.0.0.1:8080", "to": "<nkn address>"}],
+//	  "acceptAddrs": ["^<nkn address>$"],
+//	  "dialConfig": {"dialTimeout": 5000}
+//	}
+//
+// A tunnel is created for each mapping. Returns a positive handle of the
+// instance for other functions, or a negative error code.
+//
+//export CreateNknTunnelWithConfig
+func CreateNknTunnelWithConfig(config *C.char) C.longlong {
+	ti, code := parseJSONConfig(C.GoString(config))
+	if ti == nil {
+		return -C.longlong(code)
+	}
+	return addInstance(ti)
+}
+
+// GetNknTunnelLastError returns the message of the last error of exported
+// functions called from any thread, or empty string if there is none. Use
+// GetNknTunnelHandleLastError for errors of a tunnel instance, as this one
+// may be overwritten by other instances. The returned string should be freed
+// by FreeNknTunnelString.
+//
+//export GetNknTunnelLastError
+func GetNknTunnelLastError() *C.char {
+	lastErrorMutex.Lock()
+	defer lastErrorMutex.Unlock()
+	return C.CString(lastError)
+}
+
+// GetNknTunnelHandleLastError returns the message of the last error of
+// exported functions called with the tunnel instance of handle, or empty
+// string if there is none. Handle 0 is the tunnel started by StartNknTunnel.
+// Returns NULL if there is no such tunnel. The returned string should be freed
+// by FreeNknTunnelString.
+//
+//export GetNknTunnelHandleLastError
+func GetNknTunnelHandleLastError(handle C.longlong) *C.char {
+	ti := getInstanceOrDefault(handle)
+	if ti == nil {
+		fail(errNoTunnel, fmt.Errorf("no tunnel of handle %d", handle))
+		return nil
+	}
+	return C.CString(ti.lastError())
+}
+
+// GetNknTunnelVersion returns the version of the library. The returned string
+// should be freed by FreeNknTunnelString.
+//
+//export GetNknTunnelVersion
+func GetNknTunnelVersion() *C.char {
+	return C.CString(Version)
+}
+
+// GetNknTunnelAPIVersion returns the version of exported functions, which is
+// increased when they change incompatibly or new ones are added.
+//
+//export GetNknTunnelAPIVersion
+func GetNknTunnelAPIVersion() C.int {
+	return apiVersion
+}
+
+// FreeNknTunnelString frees a string returned by the library.
+//
+//export FreeNknTunnelString
+func FreeNknTunnelString(s *C.char) {
+	C.free(unsafe.Pointer(s))
+}
+
+// GetNknTunnelStatus returns the status of the tunnel instance of handle in
+// JSON, including its state, the last error, and the state, addresses and
+// stats of each tunnel, e.g.
+//
+//	{
+//	  "state": "started",
+//	  "started": true,
+//	  "tunnels": [{"state": "listening", "from": "127.0.0.1:8080", "addr": "<nkn address>", "stats": {...}, ...}]
+//	}
+//
+// Handle 0 is the tunnel started by StartNknTunnel. Returns NULL if there is
+// no such tunnel. The returned string should be freed by FreeNknTunnelString.
+//
+//export GetNknTunnelStatus
+func GetNknTunnelStatus(handle C.longlong) *C.char {
+	ti := getInstanceOrDefault(handle)
+	if ti == nil {
+		fail(errNoTunnel, fmt.Errorf("no tunnel of handle %d", handle))
+		return nil
+	}
+	b, err := json.Marshal(ti.status())
+	if err != nil {
+		ti.fail(errInternal, fmt.Errorf("marshal status: %w", err))
+		return nil
+	}
+	return C.CString(string(b))
+}
+
+// UpdateNknTunnelAcceptAddrs sets the accept address regular expressions of
+// the tunnel instance of handle listening on NKN, as a JSON list of strings,
+// e.g. ["^<nkn address>$"]. Empty or null list accepts any address. Handle 0
+// is the tunnel started by StartNknTunnel.
+//
+//export UpdateNknTunnelAcceptAddrs
+func UpdateNknTunnelAcceptAddrs(handle C.longlong, addrs *C.char) C.int {
+	ti := getInstanceOrDefault(handle)
+	if ti == nil {
+		return fail(errNoTunnel, fmt.Errorf("no tunnel of handle %d", handle))
+	}
+	var list []string
+	if s := C.GoString(addrs); len(s) > 0 {
+		if err := json.Unmarshal([]byte(s), &list); err != nil {
+			return ti.fail(errInvalidConfig, fmt.Errorf("invalid accept addresses: %w", err))
+		}
+	}
+	if err := ti.setAcceptAddrs(list); err != nil {
+		return ti.fail(errInvalidConfig, fmt.Errorf("invalid accept addresses: %w", err))
+	}
+	return 0
+}
+
+// StartNknTunnel closes the tunnel started by previous call if any, and
+// starts a new one. Use CreateNknTunnel to run multiple tunnels.
+//
+//export StartNknTunnel
+func StartNknTunnel(numClients C.int, seedRpcServers *C.char, seedHex *C.char, identifier *C.char,
+	from *C.char, to *C.char, udp C.int, useTuna C.int,
+	tunaMaxPrice *C.char, tunaMinFee *C.char, tunaFeeRatio C.float,
+	tunaDownloadGeoDB C.int, tunaGeoDBPath *C.char, tunaMeasureBandwidth C.int, tunaMeasureStoragePath *C.char, tunaMeasurementBytesDownLink C.int,
+	verbose C.int) C.int {
+	ti, code := newTunnelInstance(numClients, seedRpcServers, seedHex, identifier, from, to, udp, useTuna,
+		tunaMaxPrice, tunaMinFee, tunaFeeRatio, tunaDownloadGeoDB, tunaGeoDBPath, tunaMeasureBandwidth,
+		tunaMeasureStoragePath, tunaMeasurementBytesDownLink, verbose)
+	if ti == nil {
+		return code
+	}
+	handle := addInstance(ti)
+
+	defaultHandleMutex.Lock()
+	lastHandle := defaultHandle
+	defaultHandle = handle
+	defaultHandleMutex.Unlock()
+
+	if lastHandle > 0 {
+		log.Println("Closing existing tunnel before starting a new one...")
+		FreeNknTunnel(lastHandle)
+	}
+
+	code = ti.start()
+	if code != 0 {
+		defaultHandleMutex.Lock()
+		if defaultHandle == handle {
+			defaultHandle = 0
+		}
+		defaultHandleMutex.Unlock()
+		removeInstance(handle)
+		return code
+	}
+	return 0
+}
+
+// CloseNknTunnel closes the tunnel started by StartNknTunnel, or cancels
+// starting it.
+//
+//export CloseNknTunnel
+func CloseNknTunnel() C.int {
+	defaultHandleMutex.Lock()
+	handle := defaultHandle
+	defaultHandle = 0
+	defaultHandleMutex.Unlock()
+
+	if handle <= 0 {
+		return fail(errNoTunnel, errors.New("no tunnel to close"))
+	}
+	return FreeNknTunnel(handle)
+}
+
 func main() {
 	defer closeLogger()
 }
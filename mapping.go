@@ -0,0 +1,139 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+)
+
+var (
+	ErrMappingExists   = errors.New("mapping already exists")
+	ErrMappingNotFound = errors.New("mapping not found")
+	ErrMappingFromNKN  = errors.New("mapping can not be added when listening on NKN")
+)
+
+// Mapping is a from and to address pair added to a tunnel at runtime.
+type Mapping struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type addedMapping struct {
+	to        string
+	listeners []net.Listener
+}
+
+// AddMapping listens at from and forwards its TCP or unix socket connections
+// to to, in addition to the tunnel's own from and to. It's only supported
+// when tunnel is not listening on NKN. The to address should not have TLS
+// options.
+func (t *Tunnel) AddMapping(from, to string) error {
+	if t.fromNKN {
+		return ErrMappingFromNKN
+	}
+
+	fromEndpoint, err := ParseEndpoint(from)
+	if err != nil {
+		return err
+	}
+	toEndpoint, err := ParseEndpoint(to)
+	if err != nil {
+		return err
+	}
+	if fromEndpoint.IsNKN() || fromEndpoint.Scheme == SchemeUDP || toEndpoint.Scheme == SchemeUDP {
+		return fmt.Errorf("%w: only tcp and unix socket mapping can be added", ErrInvalidEndpoint)
+	}
+	if toEndpoint.IsNKN() && len(toEndpoint.Address) == 0 {
+		return fmt.Errorf("%w %s: empty NKN address", ErrInvalidEndpoint, to)
+	}
+	if toEndpoint.TLS {
+		return fmt.Errorf("%w %s: tls is not supported for added mapping", ErrInvalidEndpoint, to)
+	}
+	if (toEndpoint.HasPortRange() && toEndpoint.IsNKN() || len(toEndpoint.Destination) > 0) && !t.config.Handshake {
+		return fmt.Errorf("%w %s: %w", ErrInvalidEndpoint, to, ErrHandshakeRequired)
+	}
+	err = checkPortRanges(fromEndpoint, toEndpoint)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := fromEndpoint.serverTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	key := fromEndpoint.String()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.isClosed {
+		return ErrClosed
+	}
+	if _, ok := t.mappings[key]; ok {
+		return ErrMappingExists
+	}
+
+	m := &addedMapping{to: to}
+	for _, pm := range portMappings(fromEndpoint, toEndpoint) {
+		listener, err := listenMapping(pm, tlsConfig)
+		if err != nil {
+			for _, l := range m.listeners {
+				l.Close()
+			}
+			return err
+		}
+		m.listeners = append(m.listeners, listener)
+	}
+	t.mappings[key] = m
+
+	for _, listener := range m.listeners {
+		go func(listener net.Listener) {
+			err := t.acceptLoop(listener)
+			if err != nil && !t.IsClosed() && !errors.Is(err, net.ErrClosed) {
+				log.Println("Mapping listener error:", err)
+			}
+		}(listener)
+	}
+
+	log.Println("Listening at", from)
+
+	return nil
+}
+
+// RemoveMapping closes the listeners of a mapping added by AddMapping.
+// Connections already accepted are not closed.
+func (t *Tunnel) RemoveMapping(from string) error {
+	fromEndpoint, err := ParseEndpoint(from)
+	if err != nil {
+		return err
+	}
+	key := fromEndpoint.String()
+
+	t.lock.Lock()
+	m, ok := t.mappings[key]
+	delete(t.mappings, key)
+	t.lock.Unlock()
+
+	if !ok {
+		return ErrMappingNotFound
+	}
+	for _, listener := range m.listeners {
+		listener.Close()
+	}
+	return nil
+}
+
+// Mappings returns the mappings added by AddMapping.
+func (t *Tunnel) Mappings() []*Mapping {
+	t.lock.RLock()
+	mappings := make([]*Mapping, 0, len(t.mappings))
+	for from, m := range t.mappings {
+		mappings = append(mappings, &Mapping{From: from, To: m.to})
+	}
+	t.lock.RUnlock()
+
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].From < mappings[j].From })
+	return mappings
+}
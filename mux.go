@@ -0,0 +1,154 @@
+package tunnel
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/xtaci/smux"
+)
+
+var (
+	ErrMuxNotSupported = errors.New("mux is not supported")
+)
+
+// muxSession is the persistent session to a remote NKN address that TCP
+// connections are multiplexed over. Remote not supporting mux is remembered
+// so that later connections dial sessions directly.
+type muxSession struct {
+	lock        sync.Mutex
+	sess        *smux.Session
+	mode        string
+	unsupported bool
+}
+
+func muxConfig() *smux.Config {
+	return smux.DefaultConfig()
+}
+
+// getMuxSession returns the mux session to addr, dialing a new one if there
+// is none or it's closed.
+func (t *Tunnel) getMuxSession(addr string, config *nkn.DialConfig) (*smux.Session, string, error) {
+	if t.IsClosed() {
+		return nil, "", ErrClosed
+	}
+
+	t.muxLock.Lock()
+	ms, ok := t.muxSessions[addr]
+	if !ok {
+		ms = &muxSession{}
+		t.muxSessions[addr] = ms
+	}
+	t.muxLock.Unlock()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if ms.unsupported {
+		return nil, "", ErrMuxNotSupported
+	}
+	if ms.sess != nil && !ms.sess.IsClosed() {
+		return ms.sess, ms.mode, nil
+	}
+
+	conn, _, mode, err := t.dialNKN(addr, config, &handshakeRequest{Type: handshakeTypeMux})
+	if err != nil {
+		if errors.Is(err, ErrHandshakeRejected) {
+			log.Printf("Remote %s rejected mux, fall back to session per connection: %v", addr, err)
+			ms.unsupported = true
+			return nil, "", ErrMuxNotSupported
+		}
+		return nil, "", err
+	}
+
+	sess, err := smux.Client(conn, muxConfig())
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	ms.sess = sess
+	ms.mode = mode
+
+	return sess, mode, nil
+}
+
+// dialMux opens a stream to addr over mux session and sends the handshake
+// request on it. It returns ErrMuxNotSupported if remote does not support mux.
+func (t *Tunnel) dialMux(addr string, config *nkn.DialConfig, req *handshakeRequest) (net.Conn, *handshakeResponse, string, error) {
+	var err error
+	for i := 0; i < 2; i++ {
+		var sess *smux.Session
+		var mode string
+		sess, mode, err = t.getMuxSession(addr, config)
+		if err != nil {
+			return nil, nil, "", err
+		}
+
+		var stream *smux.Stream
+		stream, err = sess.OpenStream()
+		if err != nil {
+			// Session is broken, close it and retry with a new one.
+			sess.Close()
+			continue
+		}
+
+		resp, err := dialHandshake(stream, req)
+		if err != nil {
+			stream.Close()
+			return nil, nil, "", err
+		}
+		return stream, resp, mode, nil
+	}
+	return nil, nil, "", err
+}
+
+// handleMuxSession accepts streams of a mux session and handles each of them
+// as an incoming connection.
+func (t *Tunnel) handleMuxSession(conn net.Conn, to *Endpoint, mode string) {
+	if _, ok := conn.(*smux.Stream); ok || !t.config.Mux {
+		replyHandshake(conn, nil, ErrMuxNotSupported)
+		conn.Close()
+		return
+	}
+
+	err := replyHandshake(conn, nil, nil)
+	if err != nil {
+		log.Println(err)
+		conn.Close()
+		return
+	}
+
+	sess, err := smux.Server(conn, muxConfig())
+	if err != nil {
+		log.Println(err)
+		conn.Close()
+		return
+	}
+	defer sess.Close()
+
+	for {
+		stream, err := sess.AcceptStream()
+		if err != nil {
+			return
+		}
+		go t.handleConn(stream, to, mode)
+	}
+}
+
+// closeMuxSessions closes all dialed mux sessions.
+func (t *Tunnel) closeMuxSessions() {
+	t.muxLock.Lock()
+	sessions := t.muxSessions
+	t.muxSessions = make(map[string]*muxSession)
+	t.muxLock.Unlock()
+
+	for _, ms := range sessions {
+		ms.lock.Lock()
+		if ms.sess != nil {
+			ms.sess.Close()
+		}
+		ms.lock.Unlock()
+	}
+}
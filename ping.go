@@ -0,0 +1,164 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/nknorg/nkn-sdk-go"
+	ts "github.com/nknorg/nkn-tuna-session"
+)
+
+// Modes of NKN sessions.
+const (
+	ModeTuna = "tuna"
+	ModeNKN  = "nkn"
+)
+
+const pingTimeout = 5 * time.Second
+
+// PingResult is the result of a ping attempt.
+type PingResult struct {
+	// Mode is the mode the session is established with, or empty if failed.
+	Mode string
+	// SetupTime is the time to establish the session.
+	SetupTime time.Duration
+	// RTT is the round trip time of ping handshake, or zero if remote does
+	// not answer it or handshake is not enabled.
+	RTT time.Duration
+	// TunaErr is the error of tuna session before falling back to NKN.
+	TunaErr error
+	// Err is the error of the mode tried last.
+	Err error
+	// HandshakeErr is the error of ping handshake after session is
+	// established.
+	HandshakeErr error
+}
+
+// Pinger dials sessions to a tunnel listening on NKN to diagnose
+// connectivity, with the same client setup as tunnel. If handshake is enabled,
+// ping handshake is exchanged after session is established, and remote answers
+// it without dialing its to address, so ping works even if remote upstream is
+// down. Handshake should only be enabled if remote has it enabled, otherwise
+// ping handshake is forwarded to remote upstream. Without handshake only
+// session setup is checked.
+type Pinger struct {
+	config      *Config
+	multiClient *nkn.MultiClient
+	tsClient    *ts.TunaSessionClient
+}
+
+// NewPinger creates a pinger. If tuna is true, tuna session is tried first
+// and NKN session is used as fallback.
+func NewPinger(account *nkn.Account, identifier string, tuna bool, config *Config) (*Pinger, error) {
+	config, err := MergedConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	mc, c, err := newClients(account, identifier, tuna, config, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Pinger{
+		config:      config,
+		multiClient: mc,
+		tsClient:    c,
+	}, nil
+}
+
+// Ping dials a session to addr and exchanges a ping handshake.
+func (p *Pinger) Ping(addr string) *PingResult {
+	r := &PingResult{}
+	if p.tsClient != nil {
+		p.ping(r, ModeTuna, p.tsClient, addr)
+		if r.Err == nil {
+			return r
+		}
+		r.TunaErr = r.Err
+	}
+	p.ping(r, ModeNKN, p.multiClient, addr)
+	return r
+}
+
+func (p *Pinger) ping(r *PingResult, mode string, dialer sessionDialer, addr string) {
+	start := time.Now()
+	conn, err := dialer.DialWithConfig(addr, p.config.DialConfig)
+	if err != nil {
+		r.Err = err
+		return
+	}
+	defer conn.Close()
+
+	r.Mode = mode
+	r.SetupTime = time.Since(start)
+	r.Err = nil
+	if !p.config.Handshake {
+		return
+	}
+
+	// A rejected handshake still makes a round trip, e.g. from remote not
+	// supporting ping.
+	start = time.Now()
+	err = pingHandshake(conn)
+	if err == nil || errors.Is(err, ErrHandshakeRejected) {
+		r.RTT = time.Since(start)
+	}
+	r.HandshakeErr = err
+}
+
+func pingHandshake(conn net.Conn) error {
+	err := writeHandshake(conn, &handshakeRequest{Type: handshakeTypePing})
+	if err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(pingTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	resp := &handshakeResponse{}
+	err = readHandshake(conn, resp)
+	if err != nil {
+		return err
+	}
+	if len(resp.Error) > 0 {
+		return fmt.Errorf("%w: %s", ErrHandshakeRejected, resp.Error)
+	}
+	return nil
+}
+
+// Close closes the clients of pinger.
+func (p *Pinger) Close() error {
+	var errs error
+	if p.tsClient != nil {
+		if err := p.tsClient.Close(); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	if err := p.multiClient.Close(); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	return errs
+}
+
+// handlePing answers a ping handshake, and returns the next handshake request
+// of remote. Remote either closes the session after ping, or sends the next
+// request within handshake timeout, e.g. to keep pooled sessions alive. It
+// returns nil and closes conn if there is no next request.
+func (t *Tunnel) handlePing(conn net.Conn) *handshakeRequest {
+	err := replyHandshake(conn, nil, nil)
+	if err == nil {
+		conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+		req := &handshakeRequest{}
+		err = readHandshake(conn, req)
+		conn.SetReadDeadline(time.Time{})
+		if err == nil {
+			return req
+		}
+	}
+	conn.Close()
+	return nil
+}
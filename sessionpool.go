@@ -0,0 +1,224 @@
+package tunnel
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// With handshake, remote handles a session without handshake as plain, and
+// waits for the next request after ping within handshake timeout. Pooled
+// sessions are pinged once established and every keepalive interval while
+// idle, so that they are kept open for handshake.
+const sessionPoolKeepaliveInterval = handshakeTimeout / 3
+
+// sessionConn is an NKN session that can be pooled.
+type sessionConn interface {
+	net.Conn
+	IsClosed() bool
+}
+
+type pooledSession struct {
+	sess       sessionConn
+	mode       string
+	created    time.Time
+	lastActive time.Time
+}
+
+// newSessionPool creates the session pool to the NKN to address of tunnel.
+func (t *Tunnel) newSessionPool() *sessionPool {
+	maxAge := time.Duration(t.config.SessionPoolMaxAge) * time.Second
+	interval := time.Duration(t.config.SessionPoolCheckInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Second
+	}
+	addr := t.toEndpoint.Address
+	dialConfig := t.toEndpoint.dialConfig(t.config.DialConfig)
+	dial := func() (sessionConn, string, error) {
+		return t.dialer.dialSession(addr, dialConfig)
+	}
+	p := newSessionPool(addr, dial, t.config.SessionPoolMinIdle, maxAge, interval)
+	if t.config.Handshake {
+		p.keepalive = pingHandshake
+		p.keepaliveInterval = sessionPoolKeepaliveInterval
+	}
+	return p
+}
+
+// sessionPool keeps at least minIdle pre-established sessions to an NKN
+// address, so that dialing can take a ready session instead of waiting for
+// session setup. Idle sessions older than maxAge or closed are dropped by
+// health check every interval. If keepalive is set, it's called on sessions
+// once established and when they are idle for keepaliveInterval, and sessions
+// failing it are dropped.
+type sessionPool struct {
+	addr     string
+	dial     func() (sessionConn, string, error)
+	minIdle  int
+	maxAge   time.Duration
+	interval time.Duration
+
+	keepalive         func(net.Conn) error
+	keepaliveInterval time.Duration
+
+	lock     sync.Mutex
+	idle     []*pooledSession
+	dialing  int
+	keeping  int
+	closed   chan struct{}
+	isClosed bool
+}
+
+func newSessionPool(addr string, dial func() (sessionConn, string, error), minIdle int, maxAge, interval time.Duration) *sessionPool {
+	return &sessionPool{
+		addr:     addr,
+		dial:     dial,
+		minIdle:  minIdle,
+		maxAge:   maxAge,
+		interval: interval,
+		closed:   make(chan struct{}),
+	}
+}
+
+// start fills the pool and starts health check, which runs at least every
+// keepalive interval if keepalive is set.
+func (p *sessionPool) start() {
+	interval := p.interval
+	if p.keepalive != nil && p.keepaliveInterval < interval {
+		interval = p.keepaliveInterval
+	}
+	p.fill()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.check()
+				p.fill()
+			case <-p.closed:
+				return
+			}
+		}
+	}()
+}
+
+// get takes a healthy idle session from the pool with its mode, or returns
+// nil if there is none.
+func (p *sessionPool) get() (sessionConn, string) {
+	p.lock.Lock()
+	var sess sessionConn
+	var mode string
+	now := time.Now()
+	for len(p.idle) > 0 && sess == nil {
+		ps := p.idle[0]
+		p.idle = p.idle[1:]
+		if p.healthy(ps, now) {
+			sess, mode = ps.sess, ps.mode
+		} else {
+			ps.sess.Close()
+		}
+	}
+	p.lock.Unlock()
+
+	if sess != nil {
+		go p.fill()
+	}
+	return sess, mode
+}
+
+func (p *sessionPool) healthy(ps *pooledSession, now time.Time) bool {
+	return !ps.sess.IsClosed() && (p.maxAge <= 0 || now.Sub(ps.created) < p.maxAge)
+}
+
+// check drops idle sessions that are closed or too old, and keeps alive the
+// ones idle for keepalive interval. Sessions are taken out of the pool while
+// keeping alive.
+func (p *sessionPool) check() {
+	p.lock.Lock()
+	now := time.Now()
+	idle := p.idle[:0]
+	var stale []*pooledSession
+	for _, ps := range p.idle {
+		if !p.healthy(ps, now) {
+			ps.sess.Close()
+		} else if p.keepalive != nil && now.Sub(ps.lastActive) >= p.keepaliveInterval {
+			stale = append(stale, ps)
+		} else {
+			idle = append(idle, ps)
+		}
+	}
+	p.idle = idle
+	p.keeping += len(stale)
+	p.lock.Unlock()
+
+	for _, ps := range stale {
+		p.put(ps)
+		p.lock.Lock()
+		p.keeping--
+		p.lock.Unlock()
+	}
+}
+
+// put keeps alive a session and adds it to the pool, or closes it if
+// keepalive fails or pool is closed.
+func (p *sessionPool) put(ps *pooledSession) {
+	if p.keepalive != nil {
+		err := p.keepalive(ps.sess)
+		if err != nil {
+			log.Println("Keep alive pooled session error:", err)
+			ps.sess.Close()
+			return
+		}
+	}
+	ps.lastActive = time.Now()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.isClosed {
+		ps.sess.Close()
+		return
+	}
+	p.idle = append(p.idle, ps)
+}
+
+// fill dials sessions until there are minIdle idle, dialing or keeping alive
+// sessions. Failed dials are retried at next health check.
+func (p *sessionPool) fill() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for !p.isClosed && len(p.idle)+p.dialing+p.keeping < p.minIdle {
+		p.dialing++
+		go func() {
+			sess, mode, err := p.dial()
+			if err == nil {
+				p.put(&pooledSession{sess: sess, mode: mode, created: time.Now()})
+			}
+
+			p.lock.Lock()
+			p.dialing--
+			p.lock.Unlock()
+			if err != nil {
+				log.Println("Dial pooled session error:", err)
+			}
+		}()
+	}
+}
+
+// close closes all idle sessions and stops filling the pool.
+func (p *sessionPool) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.isClosed {
+		return
+	}
+	p.isClosed = true
+	close(p.closed)
+	for _, ps := range p.idle {
+		ps.sess.Close()
+	}
+	p.idle = nil
+}
@@ -0,0 +1,173 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const remoteTestAddr = "be285ff9330122cea44487a9618f96603fde6d37d5909ae1c271616772c349fe"
+
+type testSession struct {
+	net.Conn
+	closed int32
+}
+
+func (s *testSession) IsClosed() bool {
+	return atomic.LoadInt32(&s.closed) == 1
+}
+
+func (s *testSession) Close() error {
+	atomic.StoreInt32(&s.closed, 1)
+	return s.Conn.Close()
+}
+
+func newTestSession() *testSession {
+	conn, _ := net.Pipe()
+	return &testSession{Conn: conn}
+}
+
+func testSessionDial() (sessionConn, string, error) {
+	return newTestSession(), ModeNKN, nil
+}
+
+func idleCount(p *sessionPool) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.idle)
+}
+
+func waitIdle(t *testing.T, p *sessionPool, n int) {
+	deadline := time.Now().Add(time.Second)
+	for idleCount(p) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool has %d idle sessions, expected %d", idleCount(p), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSessionPoolFill(t *testing.T) {
+	p := newSessionPool("addr", testSessionDial, 2, time.Minute, time.Minute)
+	defer p.close()
+
+	p.fill()
+	waitIdle(t, p, 2)
+
+	sess, mode := p.get()
+	if sess == nil || mode != ModeNKN {
+		t.Fatalf("got session %v mode %q", sess, mode)
+	}
+	waitIdle(t, p, 2)
+
+	p.close()
+	if sess, _ := p.get(); sess != nil {
+		t.Fatal("closed pool returns session")
+	}
+}
+
+func TestSessionPoolCheck(t *testing.T) {
+	p := newSessionPool("addr", testSessionDial, 0, time.Minute, time.Minute)
+	defer p.close()
+
+	now := time.Now()
+	healthy := &pooledSession{sess: newTestSession(), created: now, lastActive: now}
+	expired := &pooledSession{sess: newTestSession(), created: now.Add(-2 * time.Minute), lastActive: now}
+	closed := &pooledSession{sess: newTestSession(), created: now, lastActive: now}
+	closed.sess.Close()
+	p.idle = []*pooledSession{healthy, expired, closed}
+
+	p.check()
+	if len(p.idle) != 1 || p.idle[0] != healthy {
+		t.Fatalf("pool has %d idle sessions after check, expected only the healthy one", len(p.idle))
+	}
+	if !expired.sess.IsClosed() {
+		t.Fatal("expired session is not closed")
+	}
+}
+
+func TestSessionPoolKeepalive(t *testing.T) {
+	var calls int32
+	var fail int32
+	p := newSessionPool("addr", testSessionDial, 0, 0, time.Minute)
+	p.keepalive = func(net.Conn) error {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&fail) == 1 {
+			return errors.New("keepalive failed")
+		}
+		return nil
+	}
+	p.keepaliveInterval = time.Second
+	defer p.close()
+
+	// Sessions are kept alive once established.
+	p.minIdle = 1
+	p.fill()
+	waitIdle(t, p, 1)
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("keepalive called %d times on new session, expected 1", calls)
+	}
+
+	// Sessions not idle for keepalive interval are not kept alive, and max
+	// age 0 keeps them however old they are.
+	p.idle[0].created = time.Now().Add(-time.Hour)
+	p.check()
+	if atomic.LoadInt32(&calls) != 1 || idleCount(p) != 1 {
+		t.Fatalf("keepalive called %d times, %d idle sessions", calls, idleCount(p))
+	}
+
+	p.idle[0].lastActive = time.Now().Add(-time.Minute)
+	p.check()
+	if atomic.LoadInt32(&calls) != 2 || idleCount(p) != 1 {
+		t.Fatalf("keepalive called %d times, %d idle sessions", calls, idleCount(p))
+	}
+
+	atomic.StoreInt32(&fail, 1)
+	p.minIdle = 0
+	sess := p.idle[0].sess
+	p.idle[0].lastActive = time.Now().Add(-time.Minute)
+	p.check()
+	if idleCount(p) != 0 || !sess.IsClosed() {
+		t.Fatal("session failing keepalive is not dropped")
+	}
+}
+
+func TestSessionPoolMaxAge(t *testing.T) {
+	to, err := ParseEndpoint(remoteTestAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := MergedConfig(&Config{Handshake: true, SessionPoolMinIdle: 1, SessionPoolMaxAge: 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun := &Tunnel{config: config, toEndpoint: to}
+	p := tun.newSessionPool()
+	if p.maxAge != 300*time.Second {
+		t.Fatalf("max age is %v, expected %v", p.maxAge, 300*time.Second)
+	}
+	if p.keepalive == nil {
+		t.Fatal("keepalive is not set with handshake")
+	}
+}
+
+// Remote answers ping handshakes of a pooled session until it's used.
+func TestSessionPoolRemoteKeepalive(t *testing.T) {
+	tun, to := newTestTunnel(t, &Config{Handshake: true})
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go tun.handleConn(local, to, ModeNKN)
+
+	for i := 0; i < 3; i++ {
+		if err := pingHandshake(remote); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := dialHandshake(remote, &handshakeRequest{Type: handshakeTypeConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, remote, "hello")
+}
@@ -0,0 +1,444 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+	ts "github.com/nknorg/nkn-tuna-session"
+	"github.com/nknorg/nkngomobile"
+	"github.com/nknorg/tuna"
+)
+
+// Actions when a tuna budget is hit.
+const (
+	// TunaBudgetActionStop stops accepting sessions until the budget resets.
+	TunaBudgetActionStop = "stop"
+	// TunaBudgetActionNKN stops accepting tuna sessions until the budget
+	// resets, so that remote falls back to free NKN sessions.
+	TunaBudgetActionNKN = "nkn"
+)
+
+// rejectAllAddrs is the accept address regex that matches no NKN address.
+const rejectAllAddrs = "^$"
+
+// Bytes of tuna sessions are counted without lock, and accounted in batches
+// of at least spendBatchBytes, or when prices are updated or spend is read.
+const spendBatchBytes = 64 << 10
+
+var (
+	ErrTunaBudgetExceeded   = errors.New("tuna budget exceeded")
+	ErrUnknownBudgetAction  = errors.New("unknown tuna budget action")
+	ErrInvalidBudget        = errors.New("invalid tuna budget")
+	ErrTunaBudgetNotFromNKN = errors.New("tuna budget requires listening on NKN with tuna")
+)
+
+// TunaNodeSpend is the price of a tuna node used by tuna listeners.
+type TunaNodeSpend struct {
+	Addr string `json:"addr"`
+	// InPrice and OutPrice are the prices in NKN/MB of traffic from and to
+	// remote.
+	InPrice   string    `json:"inPrice"`
+	OutPrice  string    `json:"outPrice"`
+	FirstUsed time.Time `json:"firstUsed"`
+	LastUsed  time.Time `json:"lastUsed"`
+}
+
+// TunaSpend is the spend accounting of a tunnel listening with tuna. Spent
+// NKN is estimated by bytes of tuna sessions and the highest price among tuna
+// nodes in use, as tuna sessions are spread over all tuna listeners.
+type TunaSpend struct {
+	InBytes        uint64           `json:"inBytes"`
+	OutBytes       uint64           `json:"outBytes"`
+	Spent          float64          `json:"spent"`
+	HourlySpent    float64          `json:"hourlySpent"`
+	DailySpent     float64          `json:"dailySpent"`
+	BudgetExceeded string           `json:"budgetExceeded,omitempty"`
+	Nodes          []*TunaNodeSpend `json:"nodes"`
+}
+
+// tunaBudget is the parsed tuna budgets in NKN, 0 is for no limit.
+type tunaBudget struct {
+	hourly float64
+	daily  float64
+	total  float64
+	action string
+}
+
+func parseBudget(name, s string) (float64, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("%w: %s %q", ErrInvalidBudget, name, s)
+	}
+	return v, nil
+}
+
+// parseTunaBudget parses tuna budgets of config, and returns nil if there is
+// no budget.
+func parseTunaBudget(config *Config) (*tunaBudget, error) {
+	b := &tunaBudget{action: config.TunaBudgetAction}
+	var err error
+	if b.hourly, err = parseBudget("hourly", config.TunaBudgetHourly); err != nil {
+		return nil, err
+	}
+	if b.daily, err = parseBudget("daily", config.TunaBudgetDaily); err != nil {
+		return nil, err
+	}
+	if b.total, err = parseBudget("total", config.TunaBudgetTotal); err != nil {
+		return nil, err
+	}
+	switch b.action {
+	case "":
+		b.action = TunaBudgetActionStop
+	case TunaBudgetActionStop, TunaBudgetActionNKN:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownBudgetAction, b.action)
+	}
+	if b.hourly == 0 && b.daily == 0 && b.total == 0 {
+		return nil, nil
+	}
+	return b, nil
+}
+
+// spendTracker accounts bytes and estimated NKN spent on tuna sessions, and
+// calls onExceeded when a budget is hit and onReset when the budget window
+// resets.
+type spendTracker struct {
+	budget     *tunaBudget
+	onExceeded func(error)
+	onReset    func()
+	now        func() time.Time
+
+	pendingIn   uint64 // atomic
+	pendingOut  uint64 // atomic
+	hasExceeded int32  // atomic, 1 if exceeded is not nil
+
+	lock      sync.Mutex
+	inPrice   float64
+	outPrice  float64
+	nodes     map[string]*TunaNodeSpend
+	inBytes   uint64
+	outBytes  uint64
+	spent     float64
+	hour      time.Time
+	hourSpent float64
+	day       time.Time
+	daySpent  float64
+	exceeded  error
+	conns     map[*spendConn]struct{}
+}
+
+func newSpendTracker(budget *tunaBudget, onExceeded func(error), onReset func()) *spendTracker {
+	now := time.Now().UTC()
+	return &spendTracker{
+		budget:     budget,
+		onExceeded: onExceeded,
+		onReset:    onReset,
+		now:        time.Now,
+		nodes:      make(map[string]*TunaNodeSpend),
+		hour:       now.Truncate(time.Hour),
+		day:        now.Truncate(24 * time.Hour),
+		conns:      make(map[*spendConn]struct{}),
+	}
+}
+
+// roll resets spent of the hourly and daily windows if they have passed.
+// Windows are clock hours and days in UTC.
+func (s *spendTracker) roll(now time.Time) {
+	now = now.UTC()
+	if hour := now.Truncate(time.Hour); hour.After(s.hour) {
+		s.hour = hour
+		s.hourSpent = 0
+	}
+	if day := now.Truncate(24 * time.Hour); day.After(s.day) {
+		s.day = day
+		s.daySpent = 0
+	}
+}
+
+// check returns the budget that is hit, or nil if none is.
+func (s *spendTracker) check() error {
+	if s.budget == nil {
+		return nil
+	}
+	if s.budget.total > 0 && s.spent >= s.budget.total {
+		return fmt.Errorf("%w: total budget %g NKN", ErrTunaBudgetExceeded, s.budget.total)
+	}
+	if s.budget.daily > 0 && s.daySpent >= s.budget.daily {
+		return fmt.Errorf("%w: daily budget %g NKN", ErrTunaBudgetExceeded, s.budget.daily)
+	}
+	if s.budget.hourly > 0 && s.hourSpent >= s.budget.hourly {
+		return fmt.Errorf("%w: hourly budget %g NKN", ErrTunaBudgetExceeded, s.budget.hourly)
+	}
+	return nil
+}
+
+// add counts bytes received from and sent to remote through tuna, which are
+// accounted once there are enough of them.
+func (s *spendTracker) add(in, out int) {
+	pending := atomic.AddUint64(&s.pendingIn, uint64(in)) + atomic.AddUint64(&s.pendingOut, uint64(out))
+	if pending >= spendBatchBytes {
+		s.flush()
+	}
+}
+
+// flush accounts counted bytes, and calls onExceeded if a budget is hit.
+func (s *spendTracker) flush() {
+	in := atomic.SwapUint64(&s.pendingIn, 0)
+	out := atomic.SwapUint64(&s.pendingOut, 0)
+	if in == 0 && out == 0 {
+		return
+	}
+
+	s.lock.Lock()
+	s.roll(s.now())
+	s.inBytes += in
+	s.outBytes += out
+	cost := (float64(in)*s.inPrice + float64(out)*s.outPrice) / tuna.TrafficUnit
+	s.spent += cost
+	s.hourSpent += cost
+	s.daySpent += cost
+	var err error
+	if s.exceeded == nil {
+		err = s.check()
+		s.setExceeded(err)
+	}
+	s.lock.Unlock()
+
+	if err != nil {
+		s.onExceeded(err)
+	}
+}
+
+func (s *spendTracker) setExceeded(err error) {
+	s.exceeded = err
+	if err != nil {
+		atomic.StoreInt32(&s.hasExceeded, 1)
+	} else {
+		atomic.StoreInt32(&s.hasExceeded, 0)
+	}
+}
+
+// update updates prices of tuna nodes in use, and resets exceeded budget if
+// its window has passed.
+func (s *spendTracker) update(addrs *ts.PubAddrs) {
+	// Bytes counted so far are accounted at previous prices.
+	s.flush()
+
+	s.lock.Lock()
+	now := s.now()
+	if addrs != nil {
+		var inPrice, outPrice float64
+		for _, addr := range addrs.Addrs {
+			if len(addr.IP) == 0 || addr.Port == 0 {
+				continue
+			}
+			key := net.JoinHostPort(addr.IP, strconv.Itoa(int(addr.Port)))
+			node, ok := s.nodes[key]
+			if !ok {
+				node = &TunaNodeSpend{Addr: key, FirstUsed: now}
+				s.nodes[key] = node
+			}
+			node.InPrice = addr.InPrice
+			node.OutPrice = addr.OutPrice
+			node.LastUsed = now
+			if p, err := strconv.ParseFloat(addr.InPrice, 64); err == nil && p > inPrice {
+				inPrice = p
+			}
+			if p, err := strconv.ParseFloat(addr.OutPrice, 64); err == nil && p > outPrice {
+				outPrice = p
+			}
+		}
+		s.inPrice, s.outPrice = inPrice, outPrice
+	}
+
+	s.roll(now)
+	reset := s.exceeded != nil && s.check() == nil
+	if reset {
+		s.setExceeded(nil)
+	}
+	s.lock.Unlock()
+
+	if reset {
+		s.onReset()
+	}
+}
+
+func (s *spendTracker) isExceeded() bool {
+	return atomic.LoadInt32(&s.hasExceeded) == 1
+}
+
+// closeConns closes active tuna sessions, which would keep spending.
+func (s *spendTracker) closeConns() {
+	s.lock.Lock()
+	conns := make([]*spendConn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.lock.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func (s *spendTracker) spend() *TunaSpend {
+	s.flush()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.roll(s.now())
+	spend := &TunaSpend{
+		InBytes:     s.inBytes,
+		OutBytes:    s.outBytes,
+		Spent:       s.spent,
+		HourlySpent: s.hourSpent,
+		DailySpent:  s.daySpent,
+		Nodes:       make([]*TunaNodeSpend, 0, len(s.nodes)),
+	}
+	if s.exceeded != nil {
+		spend.BudgetExceeded = s.exceeded.Error()
+	}
+	for _, node := range s.nodes {
+		n := *node
+		spend.Nodes = append(spend.Nodes, &n)
+	}
+	sort.Slice(spend.Nodes, func(i, j int) bool { return spend.Nodes[i].FirstUsed.Before(spend.Nodes[j].FirstUsed) })
+	return spend
+}
+
+// spendConn accounts bytes of a tuna session.
+type spendConn struct {
+	net.Conn
+	tracker *spendTracker
+}
+
+func (s *spendTracker) wrapConn(conn net.Conn) *spendConn {
+	c := &spendConn{Conn: conn, tracker: s}
+	s.lock.Lock()
+	s.conns[c] = struct{}{}
+	s.lock.Unlock()
+	return c
+}
+
+func (c *spendConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.tracker.add(n, 0)
+	}
+	return n, err
+}
+
+func (c *spendConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.tracker.add(0, n)
+	}
+	return n, err
+}
+
+func (c *spendConn) Close() error {
+	c.tracker.lock.Lock()
+	delete(c.tracker.conns, c)
+	c.tracker.lock.Unlock()
+	return c.Conn.Close()
+}
+
+// spendUDPConn accounts bytes of tuna UDP, and drops datagrams while budget
+// is exceeded.
+type spendUDPConn struct {
+	udpConn
+	tracker *spendTracker
+}
+
+func (c *spendUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.udpConn.ReadFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+		c.tracker.add(n, 0)
+		if !c.tracker.isExceeded() {
+			return n, addr, nil
+		}
+	}
+}
+
+func (c *spendUDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if c.tracker.isExceeded() {
+		return len(b), nil
+	}
+	n, err := c.udpConn.WriteTo(b, addr)
+	if n > 0 {
+		c.tracker.add(0, n)
+	}
+	return n, err
+}
+
+// TunaSpend returns the spend accounting of tunnel, or nil if tunnel is not
+// listening with tuna.
+func (t *Tunnel) TunaSpend() *TunaSpend {
+	if t.spend == nil {
+		return nil
+	}
+	return t.spend.spend()
+}
+
+// listenerAcceptAddrs returns the accept addresses of a NKN listener, which
+// accepts no address while tuna budget is exceeded.
+func (t *Tunnel) listenerAcceptAddrs(listener net.Listener) *nkngomobile.StringArray {
+	if t.spend != nil && t.spend.isExceeded() {
+		_, isTuna := listener.(*ts.TunaSessionClient)
+		if isTuna || t.spend.budget.action == TunaBudgetActionStop {
+			return nkn.NewStringArray(rejectAllAddrs)
+		}
+	}
+	return t.config.AcceptAddrs
+}
+
+// applyAcceptAddrs updates accept addresses of NKN listeners.
+func (t *Tunnel) applyAcceptAddrs() error {
+	for _, listener := range t.listeners {
+		err := listener.(nknListener).Listen(t.listenerAcceptAddrs(listener))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Tunnel) tunaBudgetExceeded(err error) {
+	log.Println("Tuna budget exceeded, action:", t.spend.budget.action, err)
+	t.lock.Lock()
+	if !t.isClosed {
+		if err := t.applyAcceptAddrs(); err != nil {
+			log.Println("Update accept addresses error:", err)
+		}
+	}
+	t.lock.Unlock()
+	t.spend.closeConns()
+	t.setBudgetErr(err)
+}
+
+func (t *Tunnel) tunaBudgetReset() {
+	log.Println("Tuna budget is reset")
+	t.lock.Lock()
+	if !t.isClosed {
+		if err := t.applyAcceptAddrs(); err != nil {
+			log.Println("Update accept addresses error:", err)
+		}
+	}
+	t.lock.Unlock()
+	t.setBudgetErr(nil)
+}
@@ -0,0 +1,145 @@
+package tunnel
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+	ts "github.com/nknorg/nkn-tuna-session"
+	"github.com/nknorg/tuna"
+)
+
+// newTestSpendTracker creates a spend tracker at 1 NKN/MB of received bytes
+// with clock returning *now.
+func newTestSpendTracker(budget *tunaBudget, now *time.Time) (*spendTracker, *int, *int) {
+	var exceeded, reset int
+	s := newSpendTracker(budget, func(error) { exceeded++ }, func() { reset++ })
+	s.now = func() time.Time { return *now }
+	s.inPrice = 1
+	return s, &exceeded, &reset
+}
+
+func TestSpendTrackerBudget(t *testing.T) {
+	// Local time is ahead of UTC, so local day changes before UTC day.
+	local := time.FixedZone("UTC+8", 8*60*60)
+	hour := time.Date(2100, 1, 1, 10, 30, 0, 0, time.UTC)
+	day := time.Date(2100, 1, 1, 23, 30, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name     string
+		budget   tunaBudget
+		exceedAt time.Time
+		stillAt  time.Time
+		resetAt  time.Time // zero if never reset
+	}{
+		{"hourly", tunaBudget{hourly: 1}, hour, hour.Add(29 * time.Minute), hour.Add(30 * time.Minute)},
+		{"daily", tunaBudget{daily: 1}, day, day.Add(29 * time.Minute), day.Add(30 * time.Minute)},
+		{"daily in UTC", tunaBudget{daily: 1}, day.In(local), day.Add(29 * time.Minute).In(local), day.Add(30 * time.Minute).In(local)},
+		{"total", tunaBudget{total: 1}, day, day.Add(29 * time.Minute), time.Time{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			now := tc.exceedAt
+			s, exceeded, reset := newTestSpendTracker(&tc.budget, &now)
+
+			s.add(tuna.TrafficUnit/2, 0)
+			if s.isExceeded() {
+				t.Fatal("budget is exceeded at half of it")
+			}
+			s.add(tuna.TrafficUnit/2, 0)
+			if !s.isExceeded() || *exceeded != 1 {
+				t.Fatal("budget is not exceeded")
+			}
+			s.add(tuna.TrafficUnit, 0)
+			if *exceeded != 1 {
+				t.Fatal("exceeded is called again")
+			}
+
+			now = tc.stillAt
+			s.update(nil)
+			if !s.isExceeded() || *reset != 0 {
+				t.Fatal("budget is reset before its window passes")
+			}
+
+			if tc.resetAt.IsZero() {
+				now = now.Add(365 * 24 * time.Hour)
+				s.update(nil)
+				if !s.isExceeded() {
+					t.Fatal("total budget is reset")
+				}
+				return
+			}
+			now = tc.resetAt
+			s.update(nil)
+			if s.isExceeded() || *reset != 1 {
+				t.Fatal("budget is not reset after its window passes")
+			}
+			spend := s.spend()
+			if spend.Spent != 2 || spend.BudgetExceeded != "" {
+				t.Fatalf("got spend %+v", spend)
+			}
+		})
+	}
+}
+
+func TestSpendTrackerBatch(t *testing.T) {
+	now := time.Now()
+	s, _, _ := newTestSpendTracker(&tunaBudget{total: 1000}, &now)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				s.add(100, 10)
+			}
+		}()
+	}
+	wg.Wait()
+
+	spend := s.spend()
+	if spend.InBytes != 1000000 || spend.OutBytes != 100000 {
+		t.Fatalf("got %d in bytes and %d out bytes, expected 1000000 and 100000", spend.InBytes, spend.OutBytes)
+	}
+}
+
+func TestTunaBudgetAction(t *testing.T) {
+	acceptAddrs := nkn.NewStringArray("^allowed$")
+	tunaListener := &ts.TunaSessionClient{}
+	nknListener := &nkn.MultiClient{}
+
+	testCases := []struct {
+		action string
+		tuna   string
+		nkn    string
+	}{
+		{TunaBudgetActionStop, rejectAllAddrs, rejectAllAddrs},
+		{TunaBudgetActionNKN, rejectAllAddrs, "^allowed$"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.action, func(t *testing.T) {
+			now := time.Now()
+			s, _, _ := newTestSpendTracker(&tunaBudget{total: 1, action: tc.action}, &now)
+			tun := &Tunnel{config: &Config{AcceptAddrs: acceptAddrs}, spend: s}
+
+			for _, listener := range []net.Listener{tunaListener, nknListener} {
+				if got := tun.listenerAcceptAddrs(listener); got != acceptAddrs {
+					t.Fatalf("got accept addrs %v before budget is exceeded", got.Elems())
+				}
+			}
+
+			s.add(tuna.TrafficUnit, 0)
+			if got := tun.listenerAcceptAddrs(tunaListener).Elems(); len(got) != 1 || got[0] != tc.tuna {
+				t.Fatalf("got tuna accept addrs %v, expected %q", got, tc.tuna)
+			}
+			if got := tun.listenerAcceptAddrs(nknListener).Elems(); len(got) != 1 || got[0] != tc.nkn {
+				t.Fatalf("got NKN accept addrs %v, expected %q", got, tc.nkn)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	ts "github.com/nknorg/nkn-tuna-session"
+)
+
+// State is the state of a tunnel.
+type State string
+
+// States of a tunnel. A tunnel starts in StateConnecting, moves between
+// StateListening and StateDegraded while serving, and ends in StateClosed.
+const (
+	// StateConnecting is the state before tunnel is serving, e.g. tuna
+	// listeners are connecting to tuna nodes.
+	StateConnecting State = "connecting"
+	// StateListening is the state when all listeners are serving.
+	StateListening State = "listening"
+	// StateDegraded is the state when tunnel is still serving but some
+	// listeners failed, tuna listeners are reconnecting, or tuna budget is
+	// exceeded.
+	StateDegraded State = "degraded"
+	// StateClosing is the state when tunnel is being closed.
+	StateClosing State = "closing"
+	// StateClosed is the state when tunnel is closed.
+	StateClosed State = "closed"
+)
+
+const (
+	stateChangesBufSize = 16
+	tunaCheckInterval   = 5 * time.Second
+)
+
+var (
+	ErrTunaDisconnected = errors.New("tuna listener is not connected")
+	ErrTunaReconnected  = errors.New("tuna listener reconnected")
+)
+
+// StateChange is sent to subscribers of StateChanges when the state of tunnel
+// changes.
+type StateChange struct {
+	State State
+	// Err is the cause of StateDegraded, or the error tunnel fails with for
+	// StateClosing and StateClosed.
+	Err error
+}
+
+type tunnelState struct {
+	lock        sync.Mutex
+	state       State
+	err         error
+	serving     bool
+	listenerErr error
+	budgetErr   error
+	tunaErr     error
+	ready       chan struct{}
+	done        chan struct{}
+	subscribers []chan *StateChange
+}
+
+func newTunnelState() *tunnelState {
+	return &tunnelState{
+		state: StateConnecting,
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// State returns the current state of tunnel.
+func (t *Tunnel) State() State {
+	t.state.lock.Lock()
+	defer t.state.lock.Unlock()
+	return t.state.state
+}
+
+// Err returns the cause of StateDegraded, or the error tunnel fails with for
+// StateClosing and StateClosed. Returns nil otherwise.
+func (t *Tunnel) Err() error {
+	t.state.lock.Lock()
+	defer t.state.lock.Unlock()
+	return t.state.err
+}
+
+// Ready returns a channel that is closed once tunnel is serving, i.e. state
+// becomes StateListening or StateDegraded for the first time. It is also
+// closed if tunnel is closed before being ready, check State to tell.
+func (t *Tunnel) Ready() <-chan struct{} {
+	return t.state.ready
+}
+
+// StateChanges returns a channel receiving state changes of tunnel after this
+// call. The channel is closed after StateClosed is sent. Changes are dropped
+// if the channel is not drained in time.
+func (t *Tunnel) StateChanges() <-chan *StateChange {
+	t.state.lock.Lock()
+	defer t.state.lock.Unlock()
+
+	c := make(chan *StateChange, stateChangesBufSize)
+	if t.state.state == StateClosed {
+		close(c)
+		return c
+	}
+	t.state.subscribers = append(t.state.subscribers, c)
+	return c
+}
+
+// setState changes the state of tunnel and notifies subscribers. The state
+// can not be changed once tunnel is closing.
+func (t *Tunnel) setState(state State, err error) {
+	s := t.state
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.state == state && (state != StateDegraded || errString(s.err) == errString(err)) {
+		return
+	}
+	if s.state == StateClosed || (s.state == StateClosing && state != StateClosed) {
+		return
+	}
+	if state == StateClosed && err == nil {
+		err = s.err
+	}
+	s.state = state
+	s.err = err
+
+	change := &StateChange{State: state, Err: err}
+	for _, c := range s.subscribers {
+		select {
+		case c <- change:
+		default:
+		}
+	}
+
+	switch state {
+	case StateListening, StateDegraded:
+		closeIfOpen(s.ready)
+	case StateClosed:
+		closeIfOpen(s.ready)
+		close(s.done)
+		for _, c := range s.subscribers {
+			close(c)
+		}
+		s.subscribers = nil
+	}
+}
+
+// isClosing returns whether tunnel is closing or closed.
+func (t *Tunnel) isClosing() bool {
+	state := t.State()
+	return state == StateClosing || state == StateClosed
+}
+
+// serve marks tunnel as serving.
+func (t *Tunnel) serve() {
+	t.state.lock.Lock()
+	t.state.serving = true
+	t.state.lock.Unlock()
+	t.updateState()
+}
+
+// listenerFailed marks tunnel as degraded by a listener that stops serving.
+func (t *Tunnel) listenerFailed(err error) {
+	t.state.lock.Lock()
+	if t.state.listenerErr == nil {
+		t.state.listenerErr = err
+	}
+	t.state.lock.Unlock()
+	t.updateState()
+}
+
+func (t *Tunnel) setBudgetErr(err error) {
+	t.state.lock.Lock()
+	t.state.budgetErr = err
+	t.state.lock.Unlock()
+	t.updateState()
+}
+
+func (t *Tunnel) setTunaErr(err error) {
+	t.state.lock.Lock()
+	t.state.tunaErr = err
+	t.state.lock.Unlock()
+	t.updateState()
+}
+
+// updateState sets the state of a serving tunnel by the errors of its
+// listeners.
+func (t *Tunnel) updateState() {
+	t.state.lock.Lock()
+	serving := t.state.serving
+	err := t.state.listenerErr
+	if err == nil {
+		err = t.state.budgetErr
+	}
+	if err == nil {
+		err = t.state.tunaErr
+	}
+	t.state.lock.Unlock()
+
+	if !serving {
+		return
+	}
+	if err != nil {
+		t.setState(StateDegraded, err)
+	} else {
+		t.setState(StateListening, nil)
+	}
+}
+
+// monitorTuna waits for the tuna listener to connect before tunnel is marked
+// as serving, then checks its public addresses and updates prices for spend
+// accounting and reputation of tuna nodes every tunaCheckInterval. A
+// listener without public address is disconnected, and a listener whose
+// public address changed has reconnected, both of which degrade the tunnel
+// until the next check.
+func (t *Tunnel) monitorTuna(c *ts.TunaSessionClient) {
+	select {
+	case <-c.OnConnect():
+	case <-t.state.done:
+		return
+	}
+
+	last := c.GetPubAddrs()
+	if t.spend != nil {
+		t.spend.update(last)
+	}
+	t.observeTunaNodes(last)
+	t.setTunaErr(checkTunaPubAddrs(nil, last))
+	t.serve()
+
+	ticker := time.NewTicker(tunaCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			addrs := c.GetPubAddrs()
+			if t.spend != nil {
+				t.spend.update(addrs)
+			}
+			t.observeTunaNodes(addrs)
+			t.setTunaErr(checkTunaPubAddrs(last, addrs))
+			last = addrs
+		case <-t.state.done:
+			return
+		}
+	}
+}
+
+func checkTunaPubAddrs(last, addrs *ts.PubAddrs) error {
+	if addrs == nil {
+		return ErrTunaDisconnected
+	}
+	for i, addr := range addrs.Addrs {
+		if len(addr.IP) == 0 || addr.Port == 0 {
+			return fmt.Errorf("%w: listener %d", ErrTunaDisconnected, i)
+		}
+		if last != nil && i < len(last.Addrs) && len(last.Addrs[i].IP) > 0 && (last.Addrs[i].IP != addr.IP || last.Addrs[i].Port != addr.Port) {
+			return fmt.Errorf("%w: listener %d to %s:%d", ErrTunaReconnected, i, addr.IP, addr.Port)
+		}
+	}
+	return nil
+}
+
+// closeIfOpen closes c if it is not closed yet, should be called with lock.
+func closeIfOpen(c chan struct{}) {
+	select {
+	case <-c:
+	default:
+		close(c)
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,53 @@
+package tunnel
+
+import (
+	"sync/atomic"
+)
+
+// Stats is the statistics of a tunnel.
+type Stats struct {
+	// Number of active tunneled TCP connections, and total number since
+	// tunnel is created.
+	ActiveConns int    `json:"activeConns"`
+	TotalConns  uint64 `json:"totalConns"`
+	// Total number of connections over tuna and NKN sessions.
+	TunaConns uint64 `json:"tunaConns"`
+	NKNConns  uint64 `json:"nknConns"`
+	// Number of active UDP flows.
+	UDPFlows int `json:"udpFlows"`
+	// Bytes of compressed connections before compression, and after
+	// compression as sent and received on NKN side.
+	CompressionRawBytes        uint64 `json:"compressionRawBytes"`
+	CompressionCompressedBytes uint64 `json:"compressionCompressedBytes"`
+	// CompressionRatio is raw bytes divided by compressed bytes, or 0 if
+	// nothing is compressed.
+	CompressionRatio float64 `json:"compressionRatio"`
+	// TunaSpend is the spend accounting if tunnel is listening with tuna.
+	TunaSpend *TunaSpend `json:"tunaSpend,omitempty"`
+	// TunaNodes is the reputation of tuna nodes if tunnel has tuna node lists
+	// or reputation store.
+	TunaNodes []*TunaNodeReputation `json:"tunaNodes,omitempty"`
+}
+
+// Stats returns the statistics of the tunnel.
+func (t *Tunnel) Stats() *Stats {
+	s := &Stats{
+		UDPFlows:                   t.udpFlows.len(),
+		CompressionRawBytes:        atomic.LoadUint64(&t.compressionStats.rawBytes),
+		CompressionCompressedBytes: atomic.LoadUint64(&t.compressionStats.compressedBytes),
+		TunaSpend:                  t.TunaSpend(),
+		TunaNodes:                  t.TunaNodes(),
+	}
+
+	t.connsLock.Lock()
+	s.ActiveConns = len(t.conns)
+	s.TotalConns = t.totalConns
+	s.TunaConns = t.tunaConns
+	s.NKNConns = t.nknConns
+	t.connsLock.Unlock()
+
+	if s.CompressionCompressedBytes > 0 {
+		s.CompressionRatio = float64(s.CompressionRawBytes) / float64(s.CompressionCompressedBytes)
+	}
+	return s
+}
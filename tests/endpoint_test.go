@@ -0,0 +1,90 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	tunnel "github.com/nknorg/nkn-tunnel"
+)
+
+// go test -v -run=TestParseEndpoint
+func TestParseEndpoint(t *testing.T) {
+	testCases := []struct {
+		addr    string
+		scheme  string
+		address string
+		timeout time.Duration
+	}{
+		{"", tunnel.SchemeNKN, "", 0},
+		{"nkn", tunnel.SchemeNKN, "", 0},
+		{"127.0.0.1:8080", tunnel.SchemeTCP, "127.0.0.1:8080", 0},
+		{"[::1]:8080", tunnel.SchemeTCP, "[::1]:8080", 0},
+		{"unix:/var/run/docker.sock", tunnel.SchemeUnix, "/var/run/docker.sock", 0},
+		{"unix:@abstract", tunnel.SchemeUnix, "@abstract", 0},
+		{remoteAddrs[0], tunnel.SchemeNKN, remoteAddrs[0], 0},
+		{"tcp://[::1]:8080?timeout=5s", tunnel.SchemeTCP, "[::1]:8080", 5 * time.Second},
+		{"udp://127.0.0.1:53", tunnel.SchemeUDP, "127.0.0.1:53", 0},
+		{"nkn://" + remoteAddrs[0] + "?timeout=3000", tunnel.SchemeNKN, remoteAddrs[0], 3 * time.Second},
+		{"unix:///tmp/a.sock", tunnel.SchemeUnix, "/tmp/a.sock", 0},
+		{"unix:///tmp/a.sock?tls=true&sni=example.org", tunnel.SchemeUnix, "/tmp/a.sock", 0},
+		{"unix:///tmp/a.sock?insecure=true", tunnel.SchemeUnix, "/tmp/a.sock", 0},
+		{"unix:///tmp/a.sock?cert=a.crt&key=a.key", tunnel.SchemeUnix, "/tmp/a.sock", 0},
+	}
+
+	for _, tc := range testCases {
+		e, err := tunnel.ParseEndpoint(tc.addr)
+		if err != nil {
+			t.Fatalf("ParseEndpoint(%q) err: %v", tc.addr, err)
+		}
+		if e.Scheme != tc.scheme || e.Address != tc.address || e.DialTimeout != tc.timeout {
+			t.Fatalf("ParseEndpoint(%q) got %+v", tc.addr, e)
+		}
+	}
+
+	e, err := tunnel.ParseEndpoint("tcp://example.com:443?ca=ca.crt&sni=example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.TLS || e.TLSCA != "ca.crt" || e.TLSServerName != "example.org" {
+		t.Fatalf("ParseEndpoint got %+v", e)
+	}
+
+	e, err = tunnel.ParseEndpoint("nkn://" + remoteAddrs[0] + "?dest=example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Address != remoteAddrs[0] || e.Destination != "example.com:443" {
+		t.Fatalf("ParseEndpoint got %+v", e)
+	}
+
+	portRangeCases := []struct {
+		addr    string
+		scheme  string
+		address string
+		min     int
+		max     int
+	}{
+		{"0.0.0.0:40000-40100", tunnel.SchemeTCP, "0.0.0.0", 40000, 40100},
+		{"udp://[::]:5000-5010", tunnel.SchemeUDP, "::", 5000, 5010},
+		{remoteAddrs[0] + ":40000-40100", tunnel.SchemeNKN, remoteAddrs[0], 40000, 40100},
+		{"nkn://" + remoteAddrs[0] + ":22", tunnel.SchemeNKN, remoteAddrs[0], 22, 22},
+	}
+	for _, tc := range portRangeCases {
+		e, err := tunnel.ParseEndpoint(tc.addr)
+		if err != nil {
+			t.Fatalf("ParseEndpoint(%q) err: %v", tc.addr, err)
+		}
+		if e.Scheme != tc.scheme || e.Address != tc.address || e.PortMin != tc.min || e.PortMax != tc.max {
+			t.Fatalf("ParseEndpoint(%q) got %+v", tc.addr, e)
+		}
+		if e.PortCount() != tc.max-tc.min+1 {
+			t.Fatalf("ParseEndpoint(%q) got port count %d", tc.addr, e.PortCount())
+		}
+	}
+
+	for _, addr := range []string{"0.0.0.0:100-50", "0.0.0.0:0-50", "::1", "127.0.0.1:port", "ftp://127.0.0.1:21", "tcp://127.0.0.1:80?foo=bar", "unix://", "tcp://127.0.0.1:443?cert=a.crt", "udp://127.0.0.1:53?tls=true", "tcp://127.0.0.1:80?dest=example.com:80", "nkn://" + remoteAddrs[0] + "?dest=example.com", "unix:///tmp/a.sock?tls=true", "unix:///tmp/a.sock?ca=ca.crt"} {
+		if _, err := tunnel.ParseEndpoint(addr); err == nil {
+			t.Fatalf("ParseEndpoint(%q) should fail", addr)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nknorg/nkn-sdk-go"
+	tunnel "github.com/nknorg/nkn-tunnel"
+)
+
+// go test -v -run=TestHandshakeRequired
+func TestHandshakeRequired(t *testing.T) {
+	account, err := nkn.NewAccount(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name   string
+		from   string
+		to     string
+		config *tunnel.Config
+	}{
+		{"remote forward", "nkn", toPort, &tunnel.Config{RemoteForwardAddr: remoteAddrs[0], RemoteForwardPort: 20022}},
+		{"remote forward ports", "nkn", toPort, &tunnel.Config{RemoteForwardPorts: "20000-20100"}},
+		{"udp without tuna", "nkn", toPort, &tunnel.Config{UDP: true}},
+		{"mux", fromPorts[0], remoteAddrs[0], &tunnel.Config{Mux: true}},
+		{"compression", fromPorts[0], remoteAddrs[0], &tunnel.Config{Compression: tunnel.CompressionDeflate}},
+		{"udp over session", "nkn", toPort, &tunnel.Config{UDPOverSession: true}},
+		{"dynamic to", "nkn", toPort, &tunnel.Config{DynamicTo: true}},
+		{"port range to nkn", "127.0.0.1:40000-40001", remoteAddrs[0] + ":40000-40001", &tunnel.Config{}},
+		{"port range from nkn", "nkn", "127.0.0.1:40000-40001", &tunnel.Config{}},
+		{"dest", fromPorts[0], "nkn://" + remoteAddrs[0] + "?dest=example.com:443", &tunnel.Config{}},
+	}
+
+	for _, tc := range testCases {
+		_, err := tunnel.NewTunnel(account, dialerId, tc.from, tc.to, false, tc.config, nil)
+		if !errors.Is(err, tunnel.ErrHandshakeRequired) {
+			t.Fatalf("%s got err %v, expected %v", tc.name, err, tunnel.ErrHandshakeRequired)
+		}
+	}
+}
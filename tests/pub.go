@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 	"strings"
-	"time"
 
 	nkn "github.com/nknorg/nkn-sdk-go"
 	ts "github.com/nknorg/nkn-tuna-session"
@@ -191,19 +190,28 @@ func StartTunnelListeners(tuna bool) error {
 	if err != nil {
 		return err
 	}
-	time.Sleep(10 * time.Second) // wait for tuna node is ready
-	if tuna {
-		for _, t := range tunnels {
-			ts := t.TunaSessionClient()
-			<-ts.OnConnect()
+	errChan := make(chan error, len(tunnels))
+	for _, t := range tunnels {
+		go func(t *tunnel.Tunnel) {
+			errChan <- t.Start()
+		}(t)
+	}
+
+	// Ready waits for tuna listeners to connect to tuna node.
+	for _, t := range tunnels {
+		<-t.Ready()
+		if t.State() == tunnel.StateClosed {
+			return <-errChan
+		}
+		if tuna {
 			ch <- tunaSessionConnected
 		}
 	}
 	ch <- tunnelServerIsReady
 	fmt.Printf("tunnel server is ready, toPort is %v\n", toPort)
 
-	for _, t := range tunnels {
-		err = t.Start()
+	for range tunnels {
+		err = <-errChan
 		if err != nil {
 			return err
 		}
@@ -241,7 +249,9 @@ func StartTunnelDialers(tcp, tuna bool) error {
 		}(t)
 	}
 
-	time.Sleep(5 * time.Second) // Tunnel start time
+	for _, t := range tunnels {
+		<-t.Ready()
+	}
 	ch <- tunnelClientIsReady
 	return nil
 }
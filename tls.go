@@ -0,0 +1,94 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// serverTLSConfig returns the tls config to listen at endpoint, or nil if tls
+// is not enabled.
+func (e *Endpoint) serverTLSConfig() (*tls.Config, error) {
+	if !e.TLS {
+		return nil, nil
+	}
+	if len(e.TLSCert) == 0 {
+		return nil, fmt.Errorf("%w %s: tls cert and key are required for listening", ErrInvalidEndpoint, e)
+	}
+
+	cert, err := tls.LoadX509KeyPair(e.TLSCert, e.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if len(e.TLSCA) > 0 {
+		conf.ClientCAs, err = loadCertPool(e.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return conf, nil
+}
+
+// clientTLSConfig returns the tls config to dial to endpoint, or nil if tls is
+// not enabled.
+func (e *Endpoint) clientTLSConfig() (*tls.Config, error) {
+	if !e.TLS {
+		return nil, nil
+	}
+
+	conf := &tls.Config{
+		ServerName:         e.TLSServerName,
+		InsecureSkipVerify: e.TLSInsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if len(conf.ServerName) == 0 && e.Scheme == SchemeTCP {
+		host, _, err := net.SplitHostPort(e.Address)
+		if err != nil {
+			return nil, err
+		}
+		conf.ServerName = host
+	}
+	if len(conf.ServerName) == 0 && !conf.InsecureSkipVerify {
+		return nil, fmt.Errorf("%w %s: %w", ErrInvalidEndpoint, e, ErrTLSServerNameRequired)
+	}
+
+	if len(e.TLSCA) > 0 {
+		var err error
+		conf.RootCAs, err = loadCertPool(e.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(e.TLSCert) > 0 {
+		cert, err := tls.LoadX509KeyPair(e.TLSCert, e.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	return conf, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("no certificate found in " + path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,683 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nknorg/nkn-sdk-go"
+	ts "github.com/nknorg/nkn-tuna-session"
+	"github.com/nknorg/tuna"
+	"github.com/nknorg/tuna/filter"
+	"github.com/nknorg/tuna/geo"
+	"github.com/nknorg/tuna/types"
+)
+
+const (
+	tunaNodeProbeTimeout     = 3 * time.Second
+	tunaNodeProbeInterval    = time.Minute
+	tunaNodeSaveInterval     = time.Minute
+	tunaNodeRotateTimeout    = time.Minute
+	tunaNodeProvenUptime     = 10 * time.Minute
+	tunaNodeMaxFailures      = 3
+	tunaNodeMaxUptimeHours   = 24
+	tunaNodeResolveInterval  = time.Hour
+	tunaNodeResolveBatchSize = 500
+	tunaNodeResolveMaxOffset = 5000
+	maxTunaNodeCandidates    = 8
+	latencySmoothing         = 0.3
+)
+
+var (
+	ErrInvalidTunaNode      = errors.New("invalid tuna node")
+	ErrTunaNodesNotFromNKN  = errors.New("tuna node lists and reputation require listening on NKN with tuna")
+	ErrTunaNodeNotAvailable = errors.New("tuna node is not available")
+)
+
+// TunaNodeReputation is the reputation of a tuna node observed by tuna
+// listeners. Nodes are identified by IP, as that's what tuna listeners
+// report.
+type TunaNodeReputation struct {
+	IP string `json:"ip"`
+	// Address and Metadata are the NKN address and tuna metadata of the node,
+	// which are known if the node is preferred or resolved once proven, and
+	// are needed to connect to the node again.
+	Address  string `json:"address,omitempty"`
+	Metadata string `json:"metadata,omitempty"`
+	// Latency is the smoothed TCP connect time to the node in milliseconds.
+	Latency float64 `json:"latency,omitempty"`
+	// Throughput is the smoothed bytes per second of tuna sessions through
+	// the node while they are active.
+	Throughput float64 `json:"throughput,omitempty"`
+	// Uptime is the total seconds tuna listeners are connected to the node.
+	Uptime      float64 `json:"uptime"`
+	Disconnects int     `json:"disconnects"`
+	// Failures is the number of failed attempts to reach the node.
+	Failures int       `json:"failures"`
+	LastSeen time.Time `json:"lastSeen"`
+	Score    float64   `json:"score"`
+
+	resolvedAt time.Time
+}
+
+// score rates a node by its uptime and throughput, penalized by latency and
+// disconnects.
+func (n *TunaNodeReputation) score() float64 {
+	hours := math.Min(n.Uptime/3600, tunaNodeMaxUptimeHours)
+	s := hours * (1 + n.Throughput/(1<<20)) / float64(1+n.Disconnects+n.Failures)
+	if n.Latency > 0 {
+		s *= 100 / (100 + n.Latency)
+	}
+	return s
+}
+
+// proven returns whether node has been connected long enough and failed less
+// than once per hour of uptime.
+func (n *TunaNodeReputation) proven() bool {
+	return n.Uptime >= tunaNodeProvenUptime.Seconds() && n.Disconnects+n.Failures < 1+int(n.Uptime/3600)
+}
+
+// unreliable returns whether node keeps failing without being proven.
+func (n *TunaNodeReputation) unreliable() bool {
+	return n.Disconnects+n.Failures >= tunaNodeMaxFailures && !n.proven()
+}
+
+// tunaNodes selects tuna nodes by preferred and banned lists and reputation,
+// and keeps the reputation of nodes used by tuna listeners.
+type tunaNodes struct {
+	preferred   []string
+	bannedAddrs map[string]struct{}
+	bannedNets  []*net.IPNet
+	path        string
+	topic       string
+	maxPrice    string
+
+	mc        *nkn.MultiClient
+	client    *ts.TunaSessionClient
+	preset    *types.Node
+	nknFilter *filter.NknFilter
+
+	rotateLock sync.Mutex
+
+	lock          sync.Mutex
+	nodes         map[string]*TunaNodeReputation
+	listenerIPs   []string
+	listenerNodes map[int]string // rotated listeners, others use preset
+	disconnected  map[int]time.Time
+	rotating      map[int]bool
+	lastBytes     uint64
+	lastObserve   time.Time
+	lastProbe     time.Time
+	lastSave      time.Time
+	dirty         bool
+}
+
+// parseTunaNodes parses tuna node lists and loads the reputation store of
+// config. Returns nil if none of them is set.
+func parseTunaNodes(config *Config) (*tunaNodes, error) {
+	if len(config.TunaPreferredNodes) == 0 && len(config.TunaBannedNodes) == 0 && len(config.TunaReputationFile) == 0 {
+		return nil, nil
+	}
+
+	n := &tunaNodes{
+		bannedAddrs:   make(map[string]struct{}),
+		path:          config.TunaReputationFile,
+		nodes:         make(map[string]*TunaNodeReputation),
+		listenerNodes: make(map[int]string),
+		disconnected:  make(map[int]time.Time),
+		rotating:      make(map[int]bool),
+	}
+	for _, addr := range config.TunaPreferredNodes {
+		if _, err := nkn.ClientAddrToPubKey(addr); err != nil {
+			return nil, fmt.Errorf("%w: preferred node %q: %v", ErrInvalidTunaNode, addr, err)
+		}
+		n.preferred = append(n.preferred, addr)
+	}
+	for _, s := range config.TunaBannedNodes {
+		if ipNet, err := parseIPOrCIDR(s); err == nil {
+			n.bannedNets = append(n.bannedNets, ipNet)
+			continue
+		}
+		if _, err := nkn.ClientAddrToPubKey(s); err != nil {
+			return nil, fmt.Errorf("%w: banned node %q is neither an NKN address, IP nor CIDR", ErrInvalidTunaNode, s)
+		}
+		n.bannedAddrs[s] = struct{}{}
+	}
+	if err := n.load(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func parseIPOrCIDR(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	return ipNet, err
+}
+
+// load loads the reputation store. A missing store is not an error.
+func (n *tunaNodes) load() error {
+	if len(n.path) == 0 {
+		return nil
+	}
+	b, err := os.ReadFile(n.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var nodes []*TunaNodeReputation
+	if err = json.Unmarshal(b, &nodes); err != nil {
+		return fmt.Errorf("load tuna reputation file %s: %w", n.path, err)
+	}
+	for _, node := range nodes {
+		if len(node.IP) > 0 {
+			n.nodes[node.IP] = node
+		}
+	}
+	return nil
+}
+
+// save saves the reputation store, should be called with lock.
+func (n *tunaNodes) save() error {
+	if len(n.path) == 0 || !n.dirty {
+		return nil
+	}
+	b, err := json.MarshalIndent(n.sortedNodes(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(n.path), filepath.Base(n.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), n.path); err != nil {
+		return err
+	}
+	n.dirty = false
+	n.lastSave = time.Now()
+	return nil
+}
+
+// sortedNodes returns copies of nodes by score from high to low, should be
+// called with lock.
+func (n *tunaNodes) sortedNodes() []*TunaNodeReputation {
+	nodes := make([]*TunaNodeReputation, 0, len(n.nodes))
+	for _, node := range n.nodes {
+		nn := *node
+		nn.Score = node.score()
+		nodes = append(nodes, &nn)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Score != nodes[j].Score {
+			return nodes[i].Score > nodes[j].Score
+		}
+		return nodes[i].IP < nodes[j].IP
+	})
+	return nodes
+}
+
+func (n *tunaNodes) isBanned(addr, ip string) bool {
+	if _, ok := n.bannedAddrs[addr]; ok && len(addr) > 0 {
+		return true
+	}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		for _, ipNet := range n.bannedNets {
+			if ipNet.Contains(parsed) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// node returns the reputation of node at ip, should be called with lock.
+func (n *tunaNodes) node(ip string) *TunaNodeReputation {
+	node, ok := n.nodes[ip]
+	if !ok {
+		node = &TunaNodeReputation{IP: ip}
+		n.nodes[ip] = node
+	}
+	n.dirty = true
+	return node
+}
+
+// sessionConfig returns a copy of tuna session config with banned and
+// unreliable nodes disallowed, so that tuna never selects them.
+func (n *tunaNodes) sessionConfig(conf *ts.Config) (*ts.Config, error) {
+	conf, err := ts.MergedConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	ipFilter := &geo.IPFilter{}
+	if conf.TunaIPFilter != nil {
+		*ipFilter = *conf.TunaIPFilter
+	}
+	ipFilter.Disallow = append([]geo.Location(nil), ipFilter.Disallow...)
+	for _, ipNet := range n.bannedNets {
+		ipFilter.Disallow = append(ipFilter.Disallow, geo.Location{IP: ipNet.String()})
+	}
+
+	nknFilter := &filter.NknFilter{}
+	if conf.TunaNknFilter != nil {
+		*nknFilter = *conf.TunaNknFilter
+	}
+	nknFilter.Disallow = append([]filter.NknClient(nil), nknFilter.Disallow...)
+	for addr := range n.bannedAddrs {
+		nknFilter.Disallow = append(nknFilter.Disallow, filter.NknClient{Address: addr})
+	}
+
+	n.lock.Lock()
+	for _, node := range n.nodes {
+		if node.unreliable() {
+			// Tuna treats an IP without mask as /32, which is too wide for
+			// IPv6, so the mask of a single host is explicit.
+			if ipNet, err := parseIPOrCIDR(node.IP); err == nil {
+				ipFilter.Disallow = append(ipFilter.Disallow, geo.Location{IP: ipNet.String()})
+			}
+		}
+	}
+	n.lock.Unlock()
+
+	conf.TunaIPFilter = ipFilter
+	conf.TunaNknFilter = nknFilter
+	n.nknFilter = nknFilter
+	n.topic = conf.TunaSubscriptionPrefix + conf.TunaServiceName
+	n.maxPrice = conf.TunaMaxPrice
+	return conf, nil
+}
+
+// lookup gets the latest metadata of tuna node at addr.
+func (n *tunaNodes) lookup(addr string) (*types.Node, error) {
+	sub, err := n.mc.GetSubscription(n.topic, addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(sub.Meta) == 0 {
+		return nil, fmt.Errorf("%w: %s is not subscribed to %s", ErrTunaNodeNotAvailable, addr, n.topic)
+	}
+	metadata, err := tuna.ReadMetadata(sub.Meta)
+	if err != nil {
+		return nil, err
+	}
+	return &types.Node{Address: addr, Metadata: metadata, MetadataRaw: sub.Meta}, nil
+}
+
+// checkPrice returns an error if node is more expensive than max price.
+func (n *tunaNodes) checkPrice(node *types.Node) error {
+	maxIn, maxOut, err := tuna.ParsePrice(n.maxPrice)
+	if err != nil {
+		return err
+	}
+	in, out, err := tuna.ParsePrice(node.Metadata.Price)
+	if err != nil {
+		return err
+	}
+	if in > maxIn || out > maxOut {
+		return fmt.Errorf("%w: price %s of %s is higher than %s", ErrTunaNodeNotAvailable, node.Metadata.Price, node.Address, n.maxPrice)
+	}
+	return nil
+}
+
+// probe measures TCP connect time to node, and records it in reputation.
+func (n *tunaNodes) probe(node *types.Node) error {
+	addr := net.JoinHostPort(node.Metadata.Ip, strconv.Itoa(int(node.Metadata.TcpPort)))
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, tunaNodeProbeTimeout)
+	latency := float64(time.Since(start)) / float64(time.Millisecond)
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	r := n.node(node.Metadata.Ip)
+	r.Address = node.Address
+	r.Metadata = node.MetadataRaw
+	if err != nil {
+		r.Failures++
+		return err
+	}
+	conn.Close()
+	r.Latency = smooth(r.Latency, latency)
+	return nil
+}
+
+func smooth(old, v float64) float64 {
+	if old == 0 {
+		return v
+	}
+	return old + latencySmoothing*(v-old)
+}
+
+// candidates returns preferred nodes in order followed by proven nodes with
+// known address by score. If after is one of them, candidates following it
+// come first, followed by the ones before it.
+func (n *tunaNodes) candidates(after string) []string {
+	n.lock.Lock()
+	nodes := n.sortedNodes()
+	n.lock.Unlock()
+
+	seen := make(map[string]struct{})
+	addrs := make([]string, 0, maxTunaNodeCandidates)
+	add := func(addr string) {
+		if _, ok := seen[addr]; ok || len(addrs) >= maxTunaNodeCandidates {
+			return
+		}
+		seen[addr] = struct{}{}
+		addrs = append(addrs, addr)
+	}
+	for _, addr := range n.preferred {
+		if !n.isBanned(addr, "") {
+			add(addr)
+		}
+	}
+	for _, node := range nodes {
+		if len(node.Address) > 0 && len(node.Metadata) > 0 && node.proven() && !n.isBanned(node.Address, node.IP) {
+			add(node.Address)
+		}
+	}
+
+	for i, addr := range addrs {
+		if addr == after {
+			return append(addrs[i+1:len(addrs):len(addrs)], addrs[:i]...)
+		}
+	}
+	return addrs
+}
+
+// selectNode returns the first reachable node among candidates after the
+// node at address after, or nil if none is reachable so that tuna selects
+// nodes by itself.
+func (n *tunaNodes) selectNode(after string) *types.Node {
+	addrs := n.candidates(after)
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	nodes := make([]*types.Node, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			node, err := n.lookup(addr)
+			if err == nil && n.isBanned(addr, node.Metadata.Ip) {
+				err = fmt.Errorf("%w: %s is banned", ErrTunaNodeNotAvailable, node.Metadata.Ip)
+			}
+			if err == nil {
+				err = n.checkPrice(node)
+			}
+			if err == nil {
+				err = n.probe(node)
+			}
+			if err != nil {
+				log.Printf("Skip tuna node %s: %v", addr, err)
+				return
+			}
+			nodes[i] = node
+		}(i, addr)
+	}
+	wg.Wait()
+
+	for _, node := range nodes {
+		if node != nil {
+			return node
+		}
+	}
+	return nil
+}
+
+// start selects the node for tuna listeners of client unless tunaNode is
+// set, which must be called before client listens.
+func (n *tunaNodes) start(mc *nkn.MultiClient, client *ts.TunaSessionClient, tunaNode *types.Node) {
+	n.mc = mc
+	n.client = client
+	if tunaNode != nil {
+		client.SetTunaNode(tunaNode)
+		return
+	}
+	n.preset = n.selectNode("")
+	if n.preset != nil {
+		log.Printf("Use tuna node %s at %s", n.preset.Address, n.preset.Metadata.Ip)
+		client.SetTunaNode(n.preset)
+	}
+}
+
+// observe updates reputation of nodes by the public addresses of tuna
+// listeners and total bytes of tuna sessions.
+func (n *tunaNodes) observe(addrs *ts.PubAddrs, bytes uint64) {
+	now := time.Now()
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	var elapsed float64
+	if !n.lastObserve.IsZero() {
+		elapsed = now.Sub(n.lastObserve).Seconds()
+	}
+	var throughput float64
+	if bytes > n.lastBytes && elapsed > 0 {
+		throughput = float64(bytes-n.lastBytes) / elapsed
+	}
+	n.lastObserve = now
+	n.lastBytes = bytes
+
+	var ips []string
+	if addrs != nil {
+		ips = make([]string, len(addrs.Addrs))
+		for i, addr := range addrs.Addrs {
+			if len(addr.IP) > 0 && addr.Port > 0 {
+				ips[i] = addr.IP
+			}
+		}
+	}
+
+	connected := make(map[string]struct{})
+	for i := 0; i < len(ips) || i < len(n.listenerIPs); i++ {
+		var ip, last string
+		if i < len(ips) {
+			ip = ips[i]
+		}
+		if i < len(n.listenerIPs) {
+			last = n.listenerIPs[i]
+		}
+		if len(last) > 0 && ip != last {
+			n.node(last).Disconnects++
+		}
+		if len(ip) > 0 {
+			connected[ip] = struct{}{}
+			delete(n.disconnected, i)
+		} else if _, ok := n.disconnected[i]; !ok {
+			n.disconnected[i] = now
+		}
+	}
+	n.listenerIPs = ips
+
+	for ip := range connected {
+		node := n.node(ip)
+		node.Uptime += elapsed
+		node.LastSeen = now
+		if throughput > 0 {
+			node.Throughput = smooth(node.Throughput, throughput/float64(len(connected)))
+		}
+		if node.proven() && len(node.Address) == 0 && now.Sub(node.resolvedAt) > tunaNodeResolveInterval {
+			node.resolvedAt = now
+			go n.resolve(ip)
+		}
+	}
+
+	if now.Sub(n.lastProbe) >= tunaNodeProbeInterval {
+		n.lastProbe = now
+		for ip := range connected {
+			if node := n.nodes[ip]; len(node.Metadata) > 0 {
+				go n.probeMetadata(node.Address, node.Metadata)
+			}
+		}
+	}
+
+	if n.preset != nil {
+		for i, since := range n.disconnected {
+			if now.Sub(since) >= tunaNodeRotateTimeout && !n.rotating[i] {
+				n.rotating[i] = true
+				go n.rotate(i)
+			}
+		}
+	}
+
+	if now.Sub(n.lastSave) >= tunaNodeSaveInterval {
+		if err := n.save(); err != nil {
+			log.Println("Save tuna reputation error:", err)
+		}
+	}
+}
+
+func (n *tunaNodes) probeMetadata(addr, metadataRaw string) {
+	metadata, err := tuna.ReadMetadata(metadataRaw)
+	if err != nil {
+		return
+	}
+	n.probe(&types.Node{Address: addr, Metadata: metadata, MetadataRaw: metadataRaw})
+}
+
+// rotate replaces tuna listener i that stays disconnected with one connected
+// to the next reachable candidate after its node, or to a node selected by
+// tuna if none is reachable. Tuna session client only pins a node when it
+// starts listening, so rotation is pinned by allowing only the node in its
+// NKN filter while rotating.
+func (n *tunaNodes) rotate(i int) {
+	n.lock.Lock()
+	current, ok := n.listenerNodes[i]
+	if !ok {
+		current = n.preset.Address
+	}
+	n.lock.Unlock()
+
+	node := n.selectNode(current)
+	var addr string
+	if node != nil {
+		addr = node.Address
+		log.Printf("Tuna listener %d is disconnected for %v, rotate to tuna node %s at %s", i, tunaNodeRotateTimeout, node.Address, node.Metadata.Ip)
+	} else {
+		log.Printf("Tuna listener %d is disconnected for %v, rotate to another node", i, tunaNodeRotateTimeout)
+	}
+
+	if err := n.rotateTo(i, node); err != nil {
+		log.Printf("Rotate tuna listener %d error: %v", i, err)
+	}
+
+	n.lock.Lock()
+	n.listenerNodes[i] = addr
+	delete(n.rotating, i)
+	delete(n.disconnected, i)
+	n.lock.Unlock()
+}
+
+// rotateTo rotates tuna listener i to node, or to a node selected by tuna if
+// node is nil.
+func (n *tunaNodes) rotateTo(i int, node *types.Node) error {
+	n.rotateLock.Lock()
+	defer n.rotateLock.Unlock()
+
+	if node == nil {
+		return n.client.RotateOne(i)
+	}
+
+	pinned := &filter.NknFilter{
+		Allow:    []filter.NknClient{{Address: node.Address, Metadata: node.MetadataRaw}},
+		Disallow: n.nknFilter.Disallow,
+	}
+	if err := n.client.SetConfig(&ts.Config{TunaNknFilter: pinned}); err != nil {
+		return err
+	}
+	defer func() {
+		if err := n.client.SetConfig(&ts.Config{TunaNknFilter: n.nknFilter}); err != nil {
+			log.Println("Restore tuna NKN filter error:", err)
+		}
+	}()
+	return n.client.RotateOne(i)
+}
+
+// resolve finds the NKN address and metadata of the proven node at ip among
+// tuna subscribers, so that it can be selected again after restart.
+func (n *tunaNodes) resolve(ip string) {
+	for offset := 0; offset < tunaNodeResolveMaxOffset; offset += tunaNodeResolveBatchSize {
+		subs, err := n.mc.GetSubscribers(n.topic, offset, tunaNodeResolveBatchSize, true, false, nil)
+		if err != nil {
+			log.Printf("Resolve tuna node %s error: %v", ip, err)
+			return
+		}
+		m := subs.Subscribers.Map()
+		for addr, meta := range m {
+			metadata, err := tuna.ReadMetadata(meta)
+			if err != nil || metadata.Ip != ip {
+				continue
+			}
+			n.lock.Lock()
+			node := n.node(ip)
+			node.Address = addr
+			node.Metadata = meta
+			n.lock.Unlock()
+			return
+		}
+		if len(m) < tunaNodeResolveBatchSize {
+			return
+		}
+	}
+}
+
+// close saves the reputation store.
+func (n *tunaNodes) close() error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.save()
+}
+
+// reputation returns the reputation of nodes by score from high to low.
+func (n *tunaNodes) reputation() []*TunaNodeReputation {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.sortedNodes()
+}
+
+func (t *Tunnel) observeTunaNodes(addrs *ts.PubAddrs) {
+	if t.tunaNodes == nil {
+		return
+	}
+	var bytes uint64
+	if t.spend != nil {
+		spend := t.spend.spend()
+		bytes = spend.InBytes + spend.OutBytes
+	}
+	t.tunaNodes.observe(addrs, bytes)
+}
+
+// TunaNodes returns the reputation of tuna nodes by score from high to low.
+// Returns nil if tunnel has no tuna node lists or reputation store.
+func (t *Tunnel) TunaNodes() []*TunaNodeReputation {
+	if t.tunaNodes == nil {
+		return nil
+	}
+	return t.tunaNodes.reputation()
+}
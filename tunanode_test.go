@@ -0,0 +1,172 @@
+package tunnel
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nknorg/tuna/geo"
+)
+
+func newTestNodeAddr(t *testing.T) string {
+	pk, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(pk)
+}
+
+func TestTunaNodesBanned(t *testing.T) {
+	bannedAddr, otherAddr := newTestNodeAddr(t), newTestNodeAddr(t)
+	n, err := parseTunaNodes(&Config{TunaBannedNodes: []string{bannedAddr, "203.0.113.1", "198.51.100.0/24", "2001:db8::1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		addr   string
+		ip     string
+		banned bool
+	}{
+		{bannedAddr, "", true},
+		{otherAddr, "", false},
+		{otherAddr, "203.0.113.1", true},
+		{"", "203.0.113.2", false},
+		{"", "198.51.100.200", true},
+		{"", "2001:db8::1", true},
+		{"", "2001:db8::2", false},
+		{"", "invalid", false},
+	}
+	for _, tc := range testCases {
+		if banned := n.isBanned(tc.addr, tc.ip); banned != tc.banned {
+			t.Errorf("isBanned(%q, %q) = %v, expected %v", tc.addr, tc.ip, banned, tc.banned)
+		}
+	}
+
+	if _, err = parseTunaNodes(&Config{TunaBannedNodes: []string{"invalid"}}); err == nil {
+		t.Fatal("invalid banned node is accepted")
+	}
+}
+
+func TestTunaNodesUnreliable(t *testing.T) {
+	n, err := parseTunaNodes(&Config{TunaReputationFile: filepath.Join(t.TempDir(), "nodes.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.node("203.0.113.1").Failures = tunaNodeMaxFailures
+	n.node("2001:db8::1").Disconnects = tunaNodeMaxFailures
+	n.node("2001:db8::2").Uptime = 3600
+
+	conf, err := n.sessionConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"203.0.113.1", false},
+		{"203.0.113.2", true},
+		{"2001:db8::1", false},
+		{"2001:db8::2", true},
+		{"2001:db8:1::1", true},
+	}
+	for _, tc := range testCases {
+		if allowed := conf.TunaIPFilter.AllowLocation(&geo.Location{IP: tc.ip}); allowed != tc.allowed {
+			t.Errorf("IP %s allowed = %v, expected %v", tc.ip, allowed, tc.allowed)
+		}
+	}
+}
+
+func TestTunaNodeScore(t *testing.T) {
+	testCases := []struct {
+		name       string
+		node       TunaNodeReputation
+		score      float64
+		proven     bool
+		unreliable bool
+	}{
+		{"new", TunaNodeReputation{}, 0, false, false},
+		{"two hours", TunaNodeReputation{Uptime: 7200}, 2, true, false},
+		{"uptime capped", TunaNodeReputation{Uptime: 100 * 3600}, tunaNodeMaxUptimeHours, true, false},
+		{"throughput", TunaNodeReputation{Uptime: 7200, Throughput: 1 << 20}, 4, true, false},
+		{"latency", TunaNodeReputation{Uptime: 7200, Latency: 100}, 1, true, false},
+		{"disconnect", TunaNodeReputation{Uptime: 7200, Disconnects: 1}, 1, true, false},
+		{"too many disconnects", TunaNodeReputation{Uptime: 7200, Disconnects: 2, Failures: 1}, 0.5, false, true},
+		{"failing new", TunaNodeReputation{Failures: tunaNodeMaxFailures}, 0, false, true},
+		{"short uptime", TunaNodeReputation{Uptime: 60}, 60.0 / 3600, false, false},
+	}
+	for _, tc := range testCases {
+		if score := tc.node.score(); score != tc.score {
+			t.Errorf("%s: score %g, expected %g", tc.name, score, tc.score)
+		}
+		if proven := tc.node.proven(); proven != tc.proven {
+			t.Errorf("%s: proven %v, expected %v", tc.name, proven, tc.proven)
+		}
+		if unreliable := tc.node.unreliable(); unreliable != tc.unreliable {
+			t.Errorf("%s: unreliable %v, expected %v", tc.name, unreliable, tc.unreliable)
+		}
+	}
+}
+
+func TestTunaNodesCandidates(t *testing.T) {
+	a, b, c, banned, proven := newTestNodeAddr(t), newTestNodeAddr(t), newTestNodeAddr(t), newTestNodeAddr(t), newTestNodeAddr(t)
+	n, err := parseTunaNodes(&Config{
+		TunaPreferredNodes: []string{a, banned, b, c},
+		TunaBannedNodes:    []string{banned},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := n.node("203.0.113.1")
+	node.Address, node.Metadata, node.Uptime = proven, "metadata", 3600
+	n.node("203.0.113.2").Uptime = 3600 // address unknown
+
+	testCases := []struct {
+		after      string
+		candidates []string
+	}{
+		{"", []string{a, b, c, proven}},
+		{a, []string{b, c, proven}},
+		{b, []string{c, proven, a}},
+		{proven, []string{a, b, c}},
+		{banned, []string{a, b, c, proven}},
+	}
+	for _, tc := range testCases {
+		if candidates := n.candidates(tc.after); !reflect.DeepEqual(candidates, tc.candidates) {
+			t.Errorf("candidates after %q = %v, expected %v", tc.after, candidates, tc.candidates)
+		}
+	}
+}
+
+func TestTunaNodesPersistence(t *testing.T) {
+	config := &Config{TunaReputationFile: filepath.Join(t.TempDir(), "nodes.json")}
+	n, err := parseTunaNodes(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastSeen := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	*n.node("203.0.113.1") = TunaNodeReputation{IP: "203.0.113.1", Address: newTestNodeAddr(t), Metadata: "metadata", Latency: 12.5, Throughput: 1024, Uptime: 7200, Disconnects: 1, LastSeen: lastSeen}
+	*n.node("2001:db8::1") = TunaNodeReputation{IP: "2001:db8::1", Uptime: 60, Failures: 2, LastSeen: lastSeen}
+	if err = n.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := parseTunaNodes(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := json.Marshal(n.reputation())
+	got, _ := json.Marshal(loaded.reputation())
+	if string(got) != string(saved) {
+		t.Fatalf("loaded reputation %s, expected %s", got, saved)
+	}
+	if len(loaded.reputation()) != 2 {
+		t.Fatalf("got %d nodes, expected 2", len(loaded.reputation()))
+	}
+}
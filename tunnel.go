@@ -1,12 +1,13 @@
 package tunnel
 
 import (
+	"crypto/tls"
 	"errors"
-	"io"
+	"fmt"
 	"log"
 	"net"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
@@ -14,14 +15,21 @@ import (
 	"github.com/nknorg/nkn-sdk-go"
 	ts "github.com/nknorg/nkn-tuna-session"
 	"github.com/nknorg/nkngomobile"
-	"github.com/patrickmn/go-cache"
+)
+
+var (
+	ErrClosed        = errors.New("tunnel closed")
+	ErrInvalidConfig = errors.New("invalid config")
 )
 
 type nknDialer interface {
 	Addr() net.Addr
 	DialWithConfig(addr string, config *nkn.DialConfig) (*ncp.Session, error)
-	DialUDPWithConfig(remoteAddr string, config *nkn.DialConfig) (*ts.UdpSession, error)
+	DialUDPWithConfig(remoteAddr string, config *nkn.DialConfig) (udpConn, error)
 	Close() error
+	// dialSession dials a session and returns the mode it's established
+	// with.
+	dialSession(addr string, config *nkn.DialConfig) (*ncp.Session, string, error)
 }
 
 type nknListener interface {
@@ -30,21 +38,72 @@ type nknListener interface {
 
 // Tunnel is the tunnel client struct.
 type Tunnel struct {
-	from        string
-	to          string
-	fromNKN     bool
-	toNKN       bool
-	config      *Config
-	dialer      nknDialer
-	listeners   []net.Listener
-	multiClient *nkn.MultiClient
-	tsClient    *ts.TunaSessionClient
-
-	lock     sync.RWMutex
-	isClosed bool
-
-	udpLock      sync.RWMutex
-	udpConnCache *cache.Cache
+	from         string
+	to           string
+	fromEndpoint *Endpoint
+	toEndpoint   *Endpoint
+	fromNKN      bool
+	toNKN        bool
+	udp          bool
+	toTLSConfig  *tls.Config
+	config       *Config
+	dialer       nknDialer
+	listeners    []net.Listener
+	multiClient  *nkn.MultiClient
+	tsClient     *ts.TunaSessionClient
+	egress       *egressChecker
+	state        *tunnelState
+	spend        *spendTracker
+	tunaNodes    *tunaNodes
+
+	lock                   sync.RWMutex
+	isClosed               bool
+	remoteForwardListeners map[net.Listener]struct{}
+	mappings               map[string]*addedMapping
+
+	connsLock  sync.Mutex
+	conns      map[uint64]*trackedConn
+	nextConnID uint64
+	totalConns uint64
+	tunaConns  uint64
+	nknConns   uint64
+
+	sessionPool *sessionPool
+
+	compressionStats compressionStats
+
+	muxLock     sync.Mutex
+	muxSessions map[string]*muxSession
+
+	udpFlows           *udpFlowTable
+	fromUDPConns       []udpConn
+	udpSessionListener *sessionUDPListener
+}
+
+// portMapping maps a local from endpoint to a to endpoint, as from endpoint
+// with port range listens at each port of the range.
+type portMapping struct {
+	from *Endpoint
+	to   *Endpoint
+}
+
+// mappedListener is a local listener whose connections are forwarded to the
+// to endpoint of its port mapping.
+type mappedListener struct {
+	net.Listener
+	to *Endpoint
+}
+
+// listenMapping listens at the local from endpoint of port mapping.
+func listenMapping(m *portMapping, tlsConfig *tls.Config) (net.Listener, error) {
+	listener, err := net.Listen(m.from.network(), m.from.Address)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	return &mappedListener{Listener: listener, to: m.to}, nil
 }
 
 // NewTunnel creates a Tunnel client with given options.
@@ -59,72 +118,70 @@ func NewTunnel(account *nkn.Account, identifier, from, to string, tuna bool, con
 
 // NewTunnels creates Tunnel clients with given options.
 // If argument `mc` is nil, then a new MultiClient will be created based on `account` and `identifier`.
+// Errors of invalid endpoints or config wrap ErrInvalidConfig.
 func NewTunnels(account *nkn.Account, identifier string, from, to []string, tuna bool, config *Config, mc *nkn.MultiClient) ([]*Tunnel, error) {
-	if len(from) != len(to) || len(from) == 0 {
-		return nil, errors.New("from should have same length as to")
+	config, err := MergedConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
 	}
 
-	config, err := MergedConfig(config)
+	fromEndpoints, toEndpoints, fromNKN, err := parseTunnels(from, to, tuna, config)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
 	}
-	if config.UDP && !tuna {
-		return nil, ErrUDPNotSupported
+	egress, err := newEgressChecker(config.EgressPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
 	}
-
-	udpConnExpired := cache.NoExpiration
-	if config.UDPIdleTime > 0 {
-		udpConnExpired = time.Duration(config.UDPIdleTime) * time.Second
+	budget, err := parseTunaBudget(config)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
 	}
-
-	fromNKN := false
-	for _, f := range from {
-		fromNKN = (len(f) == 0 || strings.ToLower(f) == "nkn")
-		if fromNKN {
-			break
-		}
+	if budget != nil && !(fromNKN && tuna) {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, ErrTunaBudgetNotFromNKN)
 	}
-	if fromNKN && len(from) > 1 {
-		return nil, errors.New("multiple tunnels is not supported when from NKN")
+	tunaNodes, err := parseTunaNodes(config)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
 	}
-
-	var c *ts.TunaSessionClient
-	var dialer nknDialer
-
-	if mc == nil {
-		mc, err = nkn.NewMultiClient(account, identifier, config.NumSubClients, config.OriginalClient, config.ClientConfig)
-		if err != nil {
-			return nil, err
+	if tunaNodes != nil {
+		if !(fromNKN && tuna) {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, ErrTunaNodesNotFromNKN)
 		}
-
-		<-mc.OnConnect.C
-	} else {
-		account = mc.Account()
-	}
-	dialer = newMultiClientDialer(mc)
-
-	if tuna {
-		wallet, err := nkn.NewWallet(account, config.WalletConfig)
+		config.TunaSessionConfig, err = tunaNodes.sessionConfig(config.TunaSessionConfig)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
 		}
+	}
 
-		c, err = ts.NewTunaSessionClient(account, mc, wallet, config.TunaSessionConfig)
-		if err != nil {
-			return nil, err
+	mc, c, err := newClients(account, identifier, tuna, config, mc)
+	if err != nil {
+		return nil, err
+	}
+	var dialer nknDialer = newMultiClientDialer(mc)
+	if c != nil {
+		tsDialer := newTunaSessionDialer(c, config)
+		dialer = tsDialer
+		if config.TunaDialMode == TunaDialModeFallback || config.TunaDialMode == TunaDialModeRace {
+			dialer = newHybridDialer(tsDialer, newMultiClientDialer(mc), config)
 		}
-
-		dialer = c
 	}
 
 	tunnels := make([]*Tunnel, 0)
 	for i, f := range from {
-		toNKN := !strings.Contains(to[i], ":")
+		fromEndpoint, toEndpoint := fromEndpoints[i], toEndpoints[i]
 		listeners := make([]net.Listener, 0, 2)
 
+		toTLSConfig, err := toEndpoint.clientTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+
 		if fromNKN {
 			if tuna {
-				if config.TunaNode != nil {
+				if tunaNodes != nil {
+					tunaNodes.start(mc, c, config.TunaNode)
+				} else if config.TunaNode != nil {
 					c.SetTunaNode(config.TunaNode)
 				}
 				listeners = append(listeners, c)
@@ -141,27 +198,56 @@ func NewTunnels(account *nkn.Account, identifier string, from, to []string, tuna
 			}
 
 			f = mc.Addr().String()
-		} else {
-			listener, err := net.Listen("tcp", f)
+		} else if fromEndpoint.Scheme != SchemeUDP {
+			tlsConfig, err := fromEndpoint.serverTLSConfig()
 			if err != nil {
 				return nil, err
 			}
-			listeners = append(listeners, listener)
+			for _, m := range portMappings(fromEndpoint, toEndpoint) {
+				listener, err := listenMapping(m, tlsConfig)
+				if err != nil {
+					for _, l := range listeners {
+						l.Close()
+					}
+					return nil, err
+				}
+				listeners = append(listeners, listener)
+			}
 		}
 
 		log.Println("Listening at", f)
 
 		t := &Tunnel{
-			from:         f,
-			to:           to[i],
-			fromNKN:      fromNKN,
-			toNKN:        toNKN,
-			config:       config,
-			dialer:       dialer,
-			listeners:    listeners,
-			multiClient:  mc,
-			tsClient:     c,
-			udpConnCache: cache.New(udpConnExpired, udpConnExpired),
+			from:                   f,
+			to:                     to[i],
+			fromEndpoint:           fromEndpoint,
+			toEndpoint:             toEndpoint,
+			fromNKN:                fromNKN,
+			toNKN:                  toEndpoint.IsNKN(),
+			udp:                    isUDPTunnel(config, fromEndpoint, toEndpoint),
+			toTLSConfig:            toTLSConfig,
+			config:                 config,
+			dialer:                 dialer,
+			listeners:              listeners,
+			multiClient:            mc,
+			tsClient:               c,
+			egress:                 egress,
+			state:                  newTunnelState(),
+			udpFlows:               newUDPFlowTable(time.Duration(config.UDPIdleTime)*time.Second, config.UDPMaxFlows),
+			remoteForwardListeners: make(map[net.Listener]struct{}),
+			mappings:               make(map[string]*addedMapping),
+			conns:                  make(map[uint64]*trackedConn),
+			muxSessions:            make(map[string]*muxSession),
+		}
+		if fromNKN && tuna {
+			t.spend = newSpendTracker(budget, t.tunaBudgetExceeded, t.tunaBudgetReset)
+			t.tunaNodes = tunaNodes
+		}
+		if fromNKN && t.udp && (!tuna || config.Handshake) {
+			t.udpSessionListener = newSessionUDPListener(t.removeUDPFlows)
+		}
+		if config.SessionPoolMinIdle > 0 && toEndpoint.IsNKN() && len(toEndpoint.Address) > 0 {
+			t.sessionPool = t.newSessionPool()
 		}
 		tunnels = append(tunnels, t)
 	}
@@ -169,11 +255,141 @@ func NewTunnels(account *nkn.Account, identifier string, from, to []string, tuna
 	return tunnels, nil
 }
 
+// parseTunnels parses and checks endpoints and config of tunnels before any
+// client is created. Config is updated if features of endpoints need
+// handshake.
+func parseTunnels(from, to []string, tuna bool, config *Config) (fromEndpoints, toEndpoints []*Endpoint, fromNKN bool, err error) {
+	if len(from) != len(to) || len(from) == 0 {
+		return nil, nil, false, errors.New("from should have same length as to")
+	}
+
+	fromEndpoints = make([]*Endpoint, len(from))
+	toEndpoints = make([]*Endpoint, len(to))
+	for i := range from {
+		fromEndpoints[i], err = ParseEndpoint(from[i])
+		if err != nil {
+			return nil, nil, false, err
+		}
+		toEndpoints[i], err = ParseEndpoint(to[i])
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if fromEndpoints[i].IsNKN() {
+			if len(fromEndpoints[i].Address) > 0 {
+				return nil, nil, false, fmt.Errorf("%w %s: cannot listen at a specific NKN address", ErrInvalidEndpoint, from[i])
+			}
+			fromNKN = true
+		}
+		if toEndpoints[i].IsNKN() && len(toEndpoints[i].Address) == 0 && len(to[i]) > 0 {
+			return nil, nil, false, fmt.Errorf("%w %s: empty NKN address", ErrInvalidEndpoint, to[i])
+		}
+		if isUDPTunnel(config, fromEndpoints[i], toEndpoints[i]) {
+			// UDP datagrams are carried inside sessions without tuna, which
+			// relies on handshake to tell them from TCP sessions.
+			if !tuna && !config.Handshake {
+				return nil, nil, false, fmt.Errorf("%w by UDP without tuna", ErrHandshakeRequired)
+			}
+			if fromEndpoints[i].Scheme == SchemeUnix || toEndpoints[i].Scheme == SchemeUnix {
+				return nil, nil, false, ErrUDPUnixSocket
+			}
+		}
+	}
+
+	if fromNKN && len(from) > 1 {
+		return nil, nil, false, errors.New("multiple tunnels is not supported when from NKN")
+	}
+	for i := range from {
+		err = checkPortRanges(fromEndpoints[i], toEndpoints[i])
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if config.Handshake {
+			continue
+		}
+		// Remote port and dynamic destination are sent in handshake.
+		if toEndpoints[i].HasPortRange() && (toEndpoints[i].IsNKN() || fromEndpoints[i].IsNKN()) {
+			return nil, nil, false, fmt.Errorf("%w by port range of %s", ErrHandshakeRequired, toEndpoints[i])
+		}
+		if len(toEndpoints[i].Destination) > 0 {
+			return nil, nil, false, fmt.Errorf("%w by dest of %s", ErrHandshakeRequired, toEndpoints[i])
+		}
+	}
+	if err = config.checkHandshake(); err != nil {
+		return nil, nil, false, err
+	}
+	if len(config.RemoteForwardAddr) > 0 && !fromNKN {
+		return nil, nil, false, ErrRemoteForwardNotFromNKN
+	}
+	if len(config.RemoteForwardPorts) > 0 {
+		if _, _, err = parsePortRange(config.RemoteForwardPorts); err != nil {
+			return nil, nil, false, err
+		}
+	}
+	if err = checkCompression(config.Compression); err != nil {
+		return nil, nil, false, err
+	}
+	if err = checkTunaDialMode(config.TunaDialMode); err != nil {
+		return nil, nil, false, err
+	}
+	if config.DynamicTo && !fromNKN {
+		return nil, nil, false, ErrDynamicToNotFromNKN
+	}
+
+	return fromEndpoints, toEndpoints, fromNKN, nil
+}
+
+// newClients creates the multiclient if mc is nil, and the tuna session
+// client if tuna is true.
+func newClients(account *nkn.Account, identifier string, tuna bool, config *Config, mc *nkn.MultiClient) (*nkn.MultiClient, *ts.TunaSessionClient, error) {
+	var err error
+	if mc == nil {
+		mc, err = nkn.NewMultiClient(account, identifier, config.NumSubClients, config.OriginalClient, config.ClientConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		<-mc.OnConnect.C
+	} else {
+		account = mc.Account()
+	}
+
+	if !tuna {
+		return mc, nil, nil
+	}
+
+	wallet, err := nkn.NewWallet(account, config.WalletConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, err := ts.NewTunaSessionClient(account, mc, wallet, config.TunaSessionConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return mc, c, nil
+}
+
 // FromAddr returns the tunnel listening address.
 func (t *Tunnel) FromAddr() string {
 	return t.from
 }
 
+// ListenAddrs returns the local addresses tunnel listens at, e.g. to find
+// the port listened at if from address has port 0. Returns nil if tunnel
+// listens on NKN.
+func (t *Tunnel) ListenAddrs() []net.Addr {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	var addrs []net.Addr
+	for _, listener := range t.listeners {
+		if l, ok := listener.(*mappedListener); ok {
+			addrs = append(addrs, l.Addr())
+		}
+	}
+	return addrs
+}
+
 // ToAddr returns the tunnel dialing address.
 func (t *Tunnel) ToAddr() string {
 	return t.to
@@ -206,81 +422,301 @@ func (t *Tunnel) TunaPubAddrs() *ts.PubAddrs {
 	return nil
 }
 
+// UDPFlowCount returns the number of active UDP flows.
+func (t *Tunnel) UDPFlowCount() int {
+	return t.udpFlows.len()
+}
+
+// AcceptAddrs returns the accept address regex for incoming sessions, or nil
+// if any address is accepted.
+func (t *Tunnel) AcceptAddrs() []string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if t.config.AcceptAddrs == nil {
+		return nil
+	}
+	return t.config.AcceptAddrs.Elems()
+}
+
 // SetAcceptAddrs updates the accept address regex for incoming sessions.
 // Tunnel will accept sessions from address that matches any of the given
 // regular expressions. If addrsRe is nil, any address will be accepted. Each
 // function call will overwrite previous accept addresses.
 func (t *Tunnel) SetAcceptAddrs(addrsRe *nkngomobile.StringArray) error {
 	if t.fromNKN {
-		for _, listener := range t.listeners {
-			err := listener.(nknListener).Listen(addrsRe)
-			if err != nil {
-				return err
-			}
-		}
+		t.lock.Lock()
+		defer t.lock.Unlock()
 		t.config.AcceptAddrs = addrsRe
+		return t.applyAcceptAddrs()
 	}
 	return nil
 }
 
-func (t *Tunnel) dial(addr string) (net.Conn, error) {
-	if t.toNKN {
-		return t.dialer.DialWithConfig(addr, t.config.DialConfig)
+func (t *Tunnel) dial(to *Endpoint) (net.Conn, string, error) {
+	switch to.Scheme {
+	case SchemeNKN:
+		req := &handshakeRequest{
+			Type:        handshakeTypeConnect,
+			Port:        to.remotePort(),
+			Destination: to.Destination,
+			Compression: t.offeredCompression(),
+		}
+		var conn net.Conn
+		var resp *handshakeResponse
+		var mode string
+		var err error
+		if t.config.Mux {
+			conn, resp, mode, err = t.dialMux(to.Address, to.dialConfig(t.config.DialConfig), req)
+		}
+		if !t.config.Mux || errors.Is(err, ErrMuxNotSupported) {
+			conn, resp, mode, err = t.dialNKN(to.Address, to.dialConfig(t.config.DialConfig), req)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if resp != nil {
+			conn = t.wrapCompression(conn, resp.Compression)
+		}
+		return conn, mode, nil
+	case SchemeUDP:
+		return nil, "", fmt.Errorf("cannot forward TCP to %s", to)
+	default:
+		dialer := &net.Dialer{Timeout: to.dialTimeout(t.config.DialConfig)}
+		var conn net.Conn
+		var err error
+		if to.TLS {
+			conn, err = tls.DialWithDialer(dialer, to.network(), to.Address, t.toTLSConfig)
+		} else {
+			conn, err = dialer.Dial(to.network(), to.Address)
+		}
+		return conn, "", err
 	}
-	var dialTimeout time.Duration
-	if t.config.DialConfig != nil {
-		dialTimeout = time.Duration(t.config.DialConfig.DialTimeout) * time.Millisecond
+}
+
+// dialNKN dials a session to an NKN address, or takes one from session pool,
+// and sends the handshake request if handshake is enabled.
+func (t *Tunnel) dialNKN(addr string, config *nkn.DialConfig, req *handshakeRequest) (net.Conn, *handshakeResponse, string, error) {
+	var conn sessionConn
+	var mode string
+	if t.sessionPool != nil && addr == t.sessionPool.addr {
+		conn, mode = t.sessionPool.get()
+	}
+	if conn == nil {
+		var err error
+		conn, mode, err = t.dialer.dialSession(addr, config)
+		if err != nil {
+			return nil, nil, "", err
+		}
+	}
+	if !t.config.Handshake {
+		return conn, nil, mode, nil
 	}
-	return net.DialTimeout("tcp", addr, dialTimeout)
+
+	resp, err := dialHandshake(conn, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, "", err
+	}
+	return conn, resp, mode, nil
 }
 
-// Start starts the tunnel and will return on error.
-func (t *Tunnel) Start() error {
-	errChan := make(chan error, 2)
+func (t *Tunnel) handleConn(fromConn net.Conn, to *Endpoint, mode string) {
+	var req *handshakeRequest
+	var early *earlyDial
+	if t.fromNKN && t.config.Handshake {
+		if !t.config.DynamicTo || !to.IsNKN() || len(to.Address) > 0 {
+			early = t.dialEarly(to)
+			defer early.discard()
+		}
+		conn, r, err := acceptHandshake(fromConn, early)
+		if err != nil {
+			log.Println("Accept handshake error:", err)
+			fromConn.Close()
+			return
+		}
+		fromConn, req = conn, r
+	}
+	if req != nil && req.Type != handshakeTypeConnect {
+		early.discard()
+		early = nil
+	}
+	for req != nil && req.Type == handshakeTypePing {
+		req = t.handlePing(fromConn)
+		if req == nil {
+			return
+		}
+	}
+	if req != nil {
+		switch req.Type {
+		case handshakeTypeConnect:
+		case handshakeTypeRemoteForward:
+			t.handleRemoteForward(fromConn, req)
+			return
+		case handshakeTypeUDP:
+			t.handleUDPSession(fromConn, req)
+			return
+		case handshakeTypeMux:
+			t.handleMuxSession(fromConn, to, mode)
+			return
+		default:
+			err := fmt.Errorf("%w: unknown type %s", ErrInvalidHandshake, req.Type)
+			log.Println(err)
+			replyHandshake(fromConn, nil, err)
+			fromConn.Close()
+			return
+		}
+	}
 
-	for _, listener := range t.listeners {
-		go func(listener net.Listener) {
-			for {
-				fromConn, err := listener.Accept()
-				if err != nil {
-					errChan <- err
-					return
-				}
-				if t.config.Verbose {
-					log.Println("Accept from", fromConn.RemoteAddr())
-				}
+	var err error
+	if req != nil && len(req.Destination) > 0 {
+		to, err = t.dynamicEndpoint(req.Destination)
+	} else if t.config.DynamicTo && to.IsNKN() && len(to.Address) == 0 {
+		err = ErrNoDestination
+	} else if req != nil {
+		to, err = requestedEndpoint(to, req.Port)
+	}
+	var toConn net.Conn
+	var dialMode string
+	if err == nil {
+		if early != nil && early.to == to {
+			toConn, dialMode, err = early.get()
+		} else {
+			toConn, dialMode, err = t.dial(to)
+		}
+	}
+	if req != nil {
+		resp := &handshakeResponse{}
+		if err == nil {
+			resp.Compression = t.negotiateCompression(req.Compression)
+		}
+		if replyErr := replyHandshake(fromConn, resp, err); replyErr != nil && err == nil {
+			err = replyErr
+			toConn.Close()
+		}
+		if err == nil {
+			fromConn = t.wrapCompression(fromConn, resp.Compression)
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		fromConn.Close()
+		return
+	}
+	if len(dialMode) > 0 {
+		mode = dialMode
+	}
+	if t.config.Verbose {
+		if len(mode) > 0 {
+			log.Println("Dial to", toConn.RemoteAddr(), "via", mode)
+		} else {
+			log.Println("Dial to", toConn.RemoteAddr())
+		}
+	}
 
-				go func(fromConn net.Conn) {
-					toConn, err := t.dial(t.to)
-					if err != nil {
-						log.Println(err)
-						fromConn.Close()
-						return
-					}
-					if t.config.Verbose {
-						log.Println("Dial to", toConn.RemoteAddr())
-					}
+	t.pipe(fromConn, toConn, mode)
+}
 
-					pipe(fromConn, toConn)
-				}(fromConn)
+// acceptLoop accepts connections from listener until it fails.
+func (t *Tunnel) acceptLoop(listener net.Listener) error {
+	mode := listenerMode(listener)
+	for {
+		fromConn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		if t.config.Verbose {
+			log.Println("Accept from", fromConn.RemoteAddr())
+		}
+
+		if _, ok := listener.(*ts.TunaSessionClient); ok && t.spend != nil {
+			if t.spend.isExceeded() {
+				fromConn.Close()
+				continue
 			}
-		}(listener)
+			fromConn = t.spend.wrapConn(fromConn)
+		}
+
+		to := t.toEndpoint
+		if l, ok := listener.(*mappedListener); ok {
+			to = l.to
+		}
+		go t.handleConn(fromConn, to, mode)
+	}
+}
+
+// Start starts the tunnel and will return on error.
+func (t *Tunnel) Start() error {
+	udpMappings := []*portMapping{{from: t.fromEndpoint, to: t.toEndpoint}}
+	if !t.fromNKN {
+		udpMappings = portMappings(t.fromEndpoint, t.toEndpoint)
+	}
+	if !t.udp {
+		udpMappings = nil
+	}
+
+	// Tunnel is degraded when one of its listeners fails, and fails when
+	// all of them fail.
+	errChan := make(chan error, len(t.listeners)+len(udpMappings)+1)
+	active := int32(len(t.listeners) + len(udpMappings))
+	listenerFailed := func(err error) {
+		if atomic.AddInt32(&active, -1) <= 0 {
+			errChan <- err
+			return
+		}
+		if !t.isClosing() {
+			log.Println("Listener error:", err)
+			t.listenerFailed(err)
+		}
+	}
+
+	if t.sessionPool != nil {
+		t.sessionPool.start()
 	}
 
-	if t.config.UDP {
-		fromUDPConn, err := t.listenUDP()
+	for _, m := range udpMappings {
+		fromUDPConn, err := t.listenUDP(m.from)
 		if err != nil {
+			t.setState(StateClosing, err)
+			t.Close()
 			return err
 		}
-		go t.udpPipe(fromUDPConn)
+		go func(to *Endpoint) {
+			listenerFailed(t.udpPipe(fromUDPConn, to))
+		}(m.to)
+	}
+
+	var tsClient *ts.TunaSessionClient
+	for _, listener := range t.listeners {
+		if c, ok := listener.(*ts.TunaSessionClient); ok {
+			tsClient = c
+		}
+		go func(listener net.Listener) {
+			listenerFailed(t.acceptLoop(listener))
+		}(listener)
+	}
+
+	if tsClient != nil {
+		go t.monitorTuna(tsClient)
+	} else {
+		t.serve()
+	}
+
+	if len(t.config.RemoteForwardAddr) > 0 {
+		go func() {
+			err := t.remoteForward()
+			if err != nil {
+				errChan <- err
+			}
+		}()
 	}
 
 	err := <-errChan
 
-	if t.IsClosed() {
+	if t.isClosing() {
 		return nil
 	}
 
+	t.setState(StateClosing, err)
 	t.Close()
 
 	return err
@@ -302,6 +738,9 @@ func (t *Tunnel) Close() error {
 		return nil
 	}
 
+	t.setState(StateClosing, nil)
+	defer t.setState(StateClosed, nil)
+
 	var errs error
 	err := t.dialer.Close()
 	if err != nil {
@@ -315,18 +754,45 @@ func (t *Tunnel) Close() error {
 		}
 	}
 
+	for _, conn := range t.fromUDPConns {
+		err = conn.Close()
+		if err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+
+	t.udpFlows.close()
+
+	t.closeMuxSessions()
+
+	if t.sessionPool != nil {
+		t.sessionPool.close()
+	}
+
+	if t.tunaNodes != nil {
+		err = t.tunaNodes.close()
+		if err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+
+	for _, m := range t.mappings {
+		for _, listener := range m.listeners {
+			err = listener.Close()
+			if err != nil {
+				errs = multierror.Append(errs, err)
+			}
+		}
+	}
+
+	for listener := range t.remoteForwardListeners {
+		err = listener.Close()
+		if err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+
 	t.isClosed = true
 
 	return errs
 }
-
-func pipe(a, b net.Conn) {
-	go func() {
-		io.Copy(a, b)
-		a.Close()
-	}()
-	go func() {
-		io.Copy(b, a)
-		b.Close()
-	}()
-}
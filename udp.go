@@ -2,17 +2,17 @@ package tunnel
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"net"
 
 	"github.com/nknorg/nkn-sdk-go"
 	ts "github.com/nknorg/nkn-tuna-session"
-	"github.com/nknorg/tuna"
-	"github.com/patrickmn/go-cache"
 )
 
 var (
-	ErrUDPNotSupported = errors.New("UDP is only supported in tuna mode")
+	ErrUDPNotSupported = errors.New("UDP is not supported")
+	ErrUDPUnixSocket   = errors.New("UDP is not supported on unix socket")
 )
 
 // Generic interface for UDP conneciton, compatabile to net.UDPConn, nkn-tuna-session.
@@ -30,20 +30,58 @@ func newMultiClientDialer(client *nkn.MultiClient) *multiClientDialer {
 	return &multiClientDialer{client}
 }
 
-func (m *multiClientDialer) DialUDPWithConfig(remoteAddr string, config *nkn.DialConfig) (*ts.UdpSession, error) {
-	return nil, ErrUDPNotSupported
+// DialUDPWithConfig carries UDP datagrams inside a session as multiclient
+// has no UDP transport.
+func (m *multiClientDialer) DialUDPWithConfig(remoteAddr string, config *nkn.DialConfig) (udpConn, error) {
+	return dialSessionUDP(m.MultiClient, remoteAddr, config, 0)
 }
 
-func (t *Tunnel) dialUDP(addr string) (udpConn, error) {
-	if t.toNKN {
-		udpSess, err := t.dialer.DialUDPWithConfig(addr, t.config.DialConfig)
+type tunaSessionDialer struct {
+	*ts.TunaSessionClient
+	config *Config
+}
+
+func newTunaSessionDialer(client *ts.TunaSessionClient, config *Config) *tunaSessionDialer {
+	return &tunaSessionDialer{client, config}
+}
+
+// DialUDPWithConfig dials tuna udp, or carries udp datagrams inside a tuna
+// session if configured or as fallback when tuna udp fails. The fallback
+// needs handshake to tell UDP sessions from TCP sessions, so it's only used if
+// handshake is enabled.
+func (d *tunaSessionDialer) DialUDPWithConfig(remoteAddr string, config *nkn.DialConfig) (udpConn, error) {
+	if d.config.UDPOverSession {
+		return dialSessionUDP(d.TunaSessionClient, remoteAddr, config, 0)
+	}
+
+	udpSess, err := d.TunaSessionClient.DialUDPWithConfig(remoteAddr, config)
+	if err != nil {
+		if !d.config.Handshake {
+			return nil, err
+		}
+		log.Println("Dial tuna UDP error, fall back to UDP over session:", err)
+		return dialSessionUDP(d.TunaSessionClient, remoteAddr, config, 0)
+	}
+	return udpSess, nil
+}
+
+func (t *Tunnel) dialUDP(to *Endpoint) (udpConn, error) {
+	if to.IsNKN() {
+		var conn udpConn
+		var err error
+		if port := to.remotePort(); port > 0 {
+			// Remote port is sent in handshake of UDP session.
+			conn, err = dialSessionUDP(t.dialer, to.Address, to.dialConfig(t.config.DialConfig), port)
+		} else {
+			conn, err = t.dialer.DialUDPWithConfig(to.Address, to.dialConfig(t.config.DialConfig))
+		}
 		if err != nil {
 			return nil, err
 		}
-		return udpSess, nil
+		return fragmentUDP(conn, t.config), nil
 	}
 
-	a, err := net.ResolveUDPAddr("udp", addr)
+	a, err := net.ResolveUDPAddr("udp", to.Address)
 	if err != nil {
 		return nil, err
 	}
@@ -55,37 +93,75 @@ func (t *Tunnel) dialUDP(addr string) (udpConn, error) {
 	return conn, nil
 }
 
-func (t *Tunnel) getToUDPConn(from net.Addr) (udpConn, bool, error) {
-	t.udpLock.Lock()
-	defer t.udpLock.Unlock()
-
-	toUDPConn, found := t.udpConnCache.Get(from.String())
-	if found {
-		return toUDPConn.(udpConn), false, nil
+// getUDPFlow returns the flow of from and to, or adds a new flow with the
+// endpoint to dial for it.
+func (t *Tunnel) getUDPFlow(from net.Addr, to *Endpoint) (*udpFlow, *Endpoint, error) {
+	flow, added, err := t.udpFlows.getOrAdd(udpFlowKey(from, to))
+	if err != nil || !added {
+		return flow, nil, err
 	}
 
-	conn, err := t.dialUDP(t.to)
+	if addr, ok := from.(*sessionUDPAddr); ok {
+		to, err = requestedEndpoint(to, addr.port)
+	} else if to.HasPortRange() && !to.IsNKN() {
+		err = fmt.Errorf("no port is requested to dial %s", to)
+	}
 	if err != nil {
-		return nil, false, err
+		t.udpFlows.remove(flow)
+		return nil, nil, err
 	}
-	t.udpConnCache.Set(from.String(), conn, cache.DefaultExpiration)
 
-	return conn, true, nil
+	return flow, to, nil
 }
 
-func (t *Tunnel) listenUDP() (udpConn, error) {
+// removeUDPFlows removes flows of a closed UDP session and closes their
+// upstream conns, which would otherwise be kept until idle eviction.
+func (t *Tunnel) removeUDPFlows(from net.Addr) {
+	t.udpFlows.removeFrom(from.String())
+}
+
+// dialUDPFlow dials upstream of a new flow, and starts reverse data pipe.
+func (t *Tunnel) dialUDPFlow(fromUDPConn udpConn, fromAddr net.Addr, flow *udpFlow, to *Endpoint) {
+	conn, err := t.dialUDP(to)
+	if err != nil {
+		log.Println("dialUDP err:", err)
+		t.udpFlows.remove(flow)
+		return
+	}
+	if !flow.setConn(conn) {
+		return
+	}
+	t.udpReversePipe(fromUDPConn, fromAddr, flow, conn)
+}
+
+func (t *Tunnel) listenUDP(from *Endpoint) (udpConn, error) {
 	var fromUDPConn udpConn
 	if t.fromNKN {
-		if t.tsClient == nil {
-			return nil, ErrUDPNotSupported
-		}
-		var err error
-		fromUDPConn, err = t.tsClient.ListenUDP()
-		if err != nil {
-			return nil, err
+		if t.tsClient == nil || t.config.UDPOverSession {
+			fromUDPConn = t.udpSessionListener
+		} else {
+			udpSess, err := t.tsClient.ListenUDP()
+			if err != nil {
+				if t.udpSessionListener == nil {
+					return nil, err
+				}
+				log.Println("Listen tuna UDP error, fall back to UDP over session:", err)
+				fromUDPConn = t.udpSessionListener
+			} else {
+				var tunaUDPConn udpConn = udpSess
+				if t.spend != nil {
+					tunaUDPConn = &spendUDPConn{udpConn: udpSess, tracker: t.spend}
+				}
+				if t.udpSessionListener != nil {
+					fromUDPConn = newMergedUDPConn(tunaUDPConn, t.udpSessionListener)
+				} else {
+					fromUDPConn = tunaUDPConn
+				}
+			}
 		}
+		fromUDPConn = fragmentUDP(fromUDPConn, t.config)
 	} else {
-		a, err := net.ResolveUDPAddr("udp", t.from)
+		a, err := net.ResolveUDPAddr("udp", from.Address)
 		if err != nil {
 			return nil, err
 		}
@@ -96,11 +172,15 @@ func (t *Tunnel) listenUDP() (udpConn, error) {
 		log.Println("Tunnel is listening at UDP", a.String())
 	}
 
+	t.lock.Lock()
+	t.fromUDPConns = append(t.fromUDPConns, fromUDPConn)
+	t.lock.Unlock()
+
 	return fromUDPConn, nil
 }
 
-func (t *Tunnel) udpPipe(fromUDPConn udpConn) error {
-	msg := make([]byte, tuna.MaxUDPBufferSize)
+func (t *Tunnel) udpPipe(fromUDPConn udpConn, to *Endpoint) error {
+	msg := make([]byte, maxSessionUDPDatagramSize)
 	for {
 		if t.IsClosed() {
 			break
@@ -109,51 +189,56 @@ func (t *Tunnel) udpPipe(fromUDPConn udpConn) error {
 		var err error
 		n, fromAddr, err := fromUDPConn.ReadFrom(msg)
 		if err != nil {
+			if t.IsClosed() {
+				return nil
+			}
 			log.Println("fromUDPConn.ReadFrom err:", err)
-			break
+			return err
 		}
 
-		toUDPConn, newDial, err := t.getToUDPConn(fromAddr)
+		flow, dialTo, err := t.getUDPFlow(fromAddr, to)
 		if err != nil {
-			log.Println("getToUDPConn err:", err)
+			log.Println("getUDPFlow err:", err)
 			continue
 		}
-
-		if conn, ok := toUDPConn.(*net.UDPConn); ok {
-			_, _, err = conn.WriteMsgUDP(msg[:n], nil, nil)
-		} else {
-			_, err = toUDPConn.WriteTo(msg[:n], nil)
+		if dialTo != nil { // New flow, dial up UDP and start reverse data pipe.
+			go t.dialUDPFlow(fromUDPConn, fromAddr, flow, dialTo)
 		}
+
+		err = flow.write(msg[:n])
 		if err != nil {
 			log.Println("toUDPConn.WriteTo err:", err)
 			continue
 		}
-		t.udpConnCache.Set(fromAddr.String(), toUDPConn, cache.DefaultExpiration)
-
-		if newDial { // New dialed up UDP, start reverse data pipe.
-			go func() {
-				msg := make([]byte, tuna.MaxUDPBufferSize)
-				for {
-					if t.IsClosed() {
-						break
-					}
-
-					n, _, err := toUDPConn.ReadFrom(msg)
-					if err != nil {
-						log.Println("toUDPConn.ReadFrom err:", err)
-						break
-					}
-					t.udpConnCache.Set(fromAddr.String(), toUDPConn, cache.DefaultExpiration)
-
-					_, err = fromUDPConn.WriteTo(msg[:n], fromAddr)
-					if err != nil {
-						log.Println("fromUDPConn.WriteTo err:", err)
-						break
-					}
-				}
-			}()
-		}
 	}
 
 	return nil
 }
+
+// udpReversePipe pipes data from upstream back to UDP client until the flow is
+// evicted or any error occurs.
+func (t *Tunnel) udpReversePipe(fromUDPConn udpConn, fromAddr net.Addr, flow *udpFlow, toUDPConn udpConn) {
+	defer t.udpFlows.remove(flow)
+
+	msg := make([]byte, maxSessionUDPDatagramSize)
+	for {
+		if t.IsClosed() {
+			return
+		}
+
+		n, _, err := toUDPConn.ReadFrom(msg)
+		if err != nil {
+			if current, ok := t.udpFlows.get(flow.key); ok && current == flow {
+				log.Println("toUDPConn.ReadFrom err:", err)
+			}
+			return
+		}
+		flow.touch()
+
+		_, err = fromUDPConn.WriteTo(msg[:n], fromAddr)
+		if err != nil {
+			log.Println("fromUDPConn.WriteTo err:", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Max number of datagrams queued for a flow while its upstream is dialing.
+const maxUDPFlowPending = 64
+
+var (
+	ErrUDPTooManyFlows = errors.New("too many UDP flows")
+	ErrUDPFlowPending  = errors.New("too many datagrams pending for UDP flow")
+)
+
+// udpFlowKey returns the key of the flow from a UDP client address to an
+// endpoint.
+func udpFlowKey(from net.Addr, to *Endpoint) string {
+	return from.String() + "/" + to.String()
+}
+
+// udpFlow is the upstream UDP conn dialed for a UDP client address. A flow is
+// added to the table before its upstream is dialed, and datagrams written
+// while dialing are queued and sent once dialed.
+type udpFlow struct {
+	key        string
+	lastActive int64 // unix nano
+
+	lock    sync.Mutex
+	conn    udpConn
+	pending [][]byte
+	closed  bool
+}
+
+// write writes b to upstream, or queues it if upstream is still dialing.
+func (f *udpFlow) write(b []byte) error {
+	f.lock.Lock()
+	if f.closed {
+		f.lock.Unlock()
+		return ErrClosed
+	}
+	if f.conn == nil {
+		defer f.lock.Unlock()
+		if len(f.pending) >= maxUDPFlowPending {
+			return ErrUDPFlowPending
+		}
+		f.pending = append(f.pending, append([]byte(nil), b...))
+		return nil
+	}
+	conn := f.conn
+	f.lock.Unlock()
+
+	err := writeUDP(conn, b)
+	if err != nil {
+		return err
+	}
+	f.touch()
+	return nil
+}
+
+// setConn sets the dialed upstream conn and sends queued datagrams to it. It
+// returns false and closes conn if the flow is closed while dialing.
+func (f *udpFlow) setConn(conn udpConn) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		conn.Close()
+		return false
+	}
+	for _, b := range f.pending {
+		err := writeUDP(conn, b)
+		if err != nil {
+			break
+		}
+	}
+	f.pending = nil
+	f.conn = conn
+	f.touch()
+	return true
+}
+
+// close closes the flow and its upstream conn if dialed.
+func (f *udpFlow) close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return
+	}
+	f.closed = true
+	f.pending = nil
+	if f.conn != nil {
+		f.conn.Close()
+	}
+}
+
+// writeUDP writes b to conn, which is connected if it's a net.UDPConn.
+func writeUDP(conn udpConn, b []byte) error {
+	var err error
+	if c, ok := conn.(*net.UDPConn); ok {
+		_, _, err = c.WriteMsgUDP(b, nil, nil)
+	} else {
+		_, err = conn.WriteTo(b, nil)
+	}
+	return err
+}
+
+func (f *udpFlow) touch() {
+	atomic.StoreInt64(&f.lastActive, time.Now().UnixNano())
+}
+
+func (f *udpFlow) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&f.lastActive))
+}
+
+// udpFlowTable tracks UDP flows by client address. Flows idle for longer than
+// idleTime are evicted and their upstream conn closed, which also stops the
+// reverse data pipe reading from it. Flows of a UDP session are removed when
+// the session is closed regardless of idleTime. Upstream conns are dialed outside of the
+// table lock, so that a slow dial does not block other flows.
+type udpFlowTable struct {
+	idleTime time.Duration
+	maxFlows int
+
+	lock     sync.Mutex
+	flows    map[string]*udpFlow
+	closed   chan struct{}
+	isClosed bool
+}
+
+// newUDPFlowTable creates a UDP flow table. Zero idleTime means flows never
+// expire, and zero maxFlows means no limit on number of flows.
+func newUDPFlowTable(idleTime time.Duration, maxFlows int) *udpFlowTable {
+	ft := &udpFlowTable{
+		idleTime: idleTime,
+		maxFlows: maxFlows,
+		flows:    make(map[string]*udpFlow),
+		closed:   make(chan struct{}),
+	}
+	if idleTime > 0 {
+		go ft.evictLoop()
+	}
+	return ft
+}
+
+func (ft *udpFlowTable) get(key string) (*udpFlow, bool) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+	flow, ok := ft.flows[key]
+	return flow, ok
+}
+
+// getOrAdd returns the flow of key, or adds a flow without upstream conn for
+// key and returns true if there is none. It returns ErrUDPTooManyFlows if the
+// table is full.
+func (ft *udpFlowTable) getOrAdd(key string) (*udpFlow, bool, error) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+
+	if ft.isClosed {
+		return nil, false, ErrClosed
+	}
+	if flow, ok := ft.flows[key]; ok {
+		return flow, false, nil
+	}
+	if ft.maxFlows > 0 && len(ft.flows) >= ft.maxFlows {
+		return nil, false, ErrUDPTooManyFlows
+	}
+
+	flow := &udpFlow{key: key}
+	flow.touch()
+	ft.flows[key] = flow
+	return flow, true, nil
+}
+
+// remove removes the flow if it's not evicted yet, and closes it.
+func (ft *udpFlowTable) remove(flow *udpFlow) {
+	ft.lock.Lock()
+	if ft.flows[flow.key] == flow {
+		delete(ft.flows, flow.key)
+	}
+	ft.lock.Unlock()
+	flow.close()
+}
+
+// removeFrom removes all flows of the UDP client address from, and closes
+// them.
+func (ft *udpFlowTable) removeFrom(from string) {
+	prefix := from + "/"
+	removed := make([]*udpFlow, 0)
+
+	ft.lock.Lock()
+	for key, flow := range ft.flows {
+		if strings.HasPrefix(key, prefix) {
+			delete(ft.flows, key)
+			removed = append(removed, flow)
+		}
+	}
+	ft.lock.Unlock()
+
+	for _, flow := range removed {
+		flow.close()
+	}
+}
+
+func (ft *udpFlowTable) len() int {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+	return len(ft.flows)
+}
+
+func (ft *udpFlowTable) evictLoop() {
+	interval := ft.idleTime / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ft.evictIdle()
+		case <-ft.closed:
+			return
+		}
+	}
+}
+
+func (ft *udpFlowTable) evictIdle() {
+	deadline := time.Now().Add(-ft.idleTime)
+	evicted := make([]*udpFlow, 0)
+
+	ft.lock.Lock()
+	for key, flow := range ft.flows {
+		if flow.idleSince().Before(deadline) {
+			delete(ft.flows, key)
+			evicted = append(evicted, flow)
+		}
+	}
+	ft.lock.Unlock()
+
+	for _, flow := range evicted {
+		flow.close()
+	}
+}
+
+// close closes all flows and stops evicting.
+func (ft *udpFlowTable) close() {
+	ft.lock.Lock()
+	if ft.isClosed {
+		ft.lock.Unlock()
+		return
+	}
+	ft.isClosed = true
+	close(ft.closed)
+	flows := ft.flows
+	ft.flows = make(map[string]*udpFlow)
+	ft.lock.Unlock()
+
+	for _, flow := range flows {
+		flow.close()
+	}
+}
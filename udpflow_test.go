@@ -0,0 +1,197 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPFlowTableMaxFlows(t *testing.T) {
+	ft := newUDPFlowTable(0, 2)
+	defer ft.close()
+
+	a, added, err := ft.getOrAdd("a")
+	if err != nil || !added {
+		t.Fatal("add a:", added, err)
+	}
+	if _, _, err = ft.getOrAdd("b"); err != nil {
+		t.Fatal("add b:", err)
+	}
+	if _, _, err = ft.getOrAdd("c"); err != ErrUDPTooManyFlows {
+		t.Fatalf("add c got %v, expected %v", err, ErrUDPTooManyFlows)
+	}
+	if flow, added, err := ft.getOrAdd("a"); err != nil || added || flow != a {
+		t.Fatal("existing flow a is not returned:", added, err)
+	}
+
+	ft.remove(a)
+	if _, _, err = ft.getOrAdd("c"); err != nil {
+		t.Fatal("add c after removing a:", err)
+	}
+	if ft.len() != 2 {
+		t.Fatalf("got %d flows, expected 2", ft.len())
+	}
+}
+
+func TestUDPFlowEviction(t *testing.T) {
+	ft := newUDPFlowTable(time.Minute, 0)
+	defer ft.close()
+
+	dialed, _, _ := ft.getOrAdd("dialed")
+	conn, _ := newTestUDPConnPair()
+	dialed.setConn(conn)
+	dialing, _, _ := ft.getOrAdd("dialing")
+	active, _, _ := ft.getOrAdd("active")
+	activeConn, _ := newTestUDPConnPair()
+	active.setConn(activeConn)
+
+	idle := time.Now().Add(-2 * time.Minute).UnixNano()
+	dialed.lastActive = idle
+	dialing.lastActive = idle
+	ft.evictIdle()
+
+	if _, ok := ft.get("active"); !ok || activeConn.isClosed() {
+		t.Fatal("active flow is evicted")
+	}
+	if _, ok := ft.get("dialed"); ok || !conn.isClosed() {
+		t.Fatal("idle flow is not evicted or its conn is not closed")
+	}
+	if _, ok := ft.get("dialing"); ok {
+		t.Fatal("idle dialing flow is not evicted")
+	}
+
+	// Conn dialed after eviction is closed.
+	conn, _ = newTestUDPConnPair()
+	if dialing.setConn(conn) || !conn.isClosed() {
+		t.Fatal("conn dialed after eviction is not closed")
+	}
+	if err := dialing.write([]byte("hello")); err != ErrClosed {
+		t.Fatalf("write to evicted flow got %v, expected %v", err, ErrClosed)
+	}
+
+	ft.close()
+	if !activeConn.isClosed() {
+		t.Fatal("conn is not closed when flow table is closed")
+	}
+	if _, _, err := ft.getOrAdd("active"); err != ErrClosed {
+		t.Fatalf("add to closed flow table got %v, expected %v", err, ErrClosed)
+	}
+}
+
+func TestUDPFlowPending(t *testing.T) {
+	ft := newUDPFlowTable(0, 0)
+	defer ft.close()
+
+	flow, _, _ := ft.getOrAdd("a")
+	for i := 0; i < maxUDPFlowPending; i++ {
+		if err := flow.write([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := flow.write([]byte{0}); err != ErrUDPFlowPending {
+		t.Fatalf("got %v, expected %v", err, ErrUDPFlowPending)
+	}
+
+	conn, peer := newTestUDPConnPair()
+	flow.setConn(conn)
+	flow.write([]byte{maxUDPFlowPending})
+	for i := 0; i <= maxUDPFlowPending; i++ {
+		if b := <-peer.recv; len(b) != 1 || b[0] != byte(i) {
+			t.Fatalf("got datagram %v, expected %d", b, i)
+		}
+	}
+}
+
+func TestUDPPipe(t *testing.T) {
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			n, addr, err := upstream.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			upstream.WriteTo(b[:n], addr)
+		}
+	}()
+
+	to, err := ParseEndpoint(upstream.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun := &Tunnel{config: &Config{}, udpFlows: newUDPFlowTable(0, 0)}
+	defer tun.udpFlows.close()
+
+	from, client := newTestUDPConnPair()
+	go tun.udpPipe(from, to)
+
+	for _, msg := range []string{"hello", "world"} {
+		client.WriteTo([]byte(msg), nil)
+		select {
+		case b := <-client.recv:
+			if string(b) != msg {
+				t.Fatalf("got %q, expected %q", b, msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for echo")
+		}
+	}
+	if tun.udpFlows.len() != 1 {
+		t.Fatalf("got %d flows, expected 1", tun.udpFlows.len())
+	}
+}
+
+func TestUDPSessionFlowRemoved(t *testing.T) {
+	// Upstream never replies, so the flow is only removed with its session.
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	received := make(chan struct{}, 1)
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			if _, _, err := upstream.ReadFrom(b); err != nil {
+				return
+			}
+			received <- struct{}{}
+		}
+	}()
+
+	to, err := ParseEndpoint(upstream.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun := &Tunnel{config: &Config{}, udpFlows: newUDPFlowTable(0, 0)}
+	defer tun.udpFlows.close()
+	tun.udpSessionListener = newSessionUDPListener(tun.removeUDPFlows)
+	defer tun.udpSessionListener.Close()
+	go tun.udpPipe(tun.udpSessionListener, to)
+
+	client, server := net.Pipe()
+	tun.udpSessionListener.addSession(server, 0)
+	if _, err := writeDatagram(client, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for datagram")
+	}
+	if tun.udpFlows.len() != 1 {
+		t.Fatalf("got %d flows, expected 1", tun.udpFlows.len())
+	}
+
+	client.Close()
+	for i := 0; tun.udpFlows.len() > 0; i++ {
+		if i == 100 {
+			t.Fatal("flow is not removed when its session is closed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,253 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UDP datagrams larger than fragment size are split into fragments on NKN
+// side if fragmentation is enabled, which both sides should do. Each fragment
+// starts with magic, version, message id, fragment index and fragment count,
+// while whole datagrams are sent as is. A whole datagram starting with the
+// magic is sent as a single fragment, so that fragments are told from whole
+// datagrams unambiguously.
+const (
+	udpFragmentMagic      = "NKNF"
+	udpFragmentVersion    = 1
+	udpFragmentHeaderSize = 4 + 1 + 4 + 2 + 2
+)
+
+var (
+	ErrInvalidUDPFragment = errors.New("invalid UDP fragment")
+)
+
+// isUDPFragment returns whether b starts with fragment magic.
+func isUDPFragment(b []byte) bool {
+	return len(b) >= len(udpFragmentMagic) && string(b[:len(udpFragmentMagic)]) == udpFragmentMagic
+}
+
+// fragmentUDPConn splits datagrams larger than fragmentSize into fragments
+// when writing, and reassembles fragments when reading.
+type fragmentUDPConn struct {
+	conn         udpConn
+	fragmentSize int
+	nextID       uint32
+	reassembler  *udpReassembler
+}
+
+// fragmentUDP returns conn fragmenting datagrams if UDPFragmentSize is set,
+// or conn itself otherwise so that datagrams are passed through unchanged to
+// and from remotes without fragmentation.
+func fragmentUDP(conn udpConn, config *Config) udpConn {
+	if config.UDPFragmentSize <= 0 {
+		return conn
+	}
+	return newFragmentUDPConn(conn, config)
+}
+
+func newFragmentUDPConn(conn udpConn, config *Config) *fragmentUDPConn {
+	return &fragmentUDPConn{
+		conn:         conn,
+		fragmentSize: config.UDPFragmentSize,
+		reassembler:  newUDPReassembler(time.Duration(config.UDPReassemblyTimeout)*time.Millisecond, config.UDPReassemblyMaxBytes),
+	}
+}
+
+func (c *fragmentUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.conn.ReadFrom(b)
+		if err != nil {
+			return 0, addr, err
+		}
+		if !isUDPFragment(b[:n]) {
+			return n, addr, nil
+		}
+
+		data, err := c.reassembler.add(addr.String(), b[:n])
+		if err != nil {
+			log.Println("Reassemble UDP fragment error:", err)
+			continue
+		}
+		if data != nil {
+			if len(data) > len(b) {
+				log.Printf("Reassembled UDP datagram of %d bytes is too large, discard it", len(data))
+				continue
+			}
+			return copy(b, data), addr, nil
+		}
+	}
+}
+
+func (c *fragmentUDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) <= c.fragmentSize && !isUDPFragment(b) {
+		return c.conn.WriteTo(b, addr)
+	}
+
+	partSize := c.fragmentSize - udpFragmentHeaderSize
+	if partSize <= 0 {
+		return 0, ErrInvalidUDPFragment
+	}
+	count := (len(b) + partSize - 1) / partSize
+	if count > 0xffff {
+		return 0, ErrUDPDatagramTooLarge
+	}
+
+	id := atomic.AddUint32(&c.nextID, 1)
+	buf := make([]byte, udpFragmentHeaderSize+partSize)
+	for i := 0; i < count; i++ {
+		part := b[i*partSize:]
+		if len(part) > partSize {
+			part = part[:partSize]
+		}
+		n := copy(buf, udpFragmentMagic)
+		buf[n] = udpFragmentVersion
+		binary.BigEndian.PutUint32(buf[n+1:], id)
+		binary.BigEndian.PutUint16(buf[n+5:], uint16(i))
+		binary.BigEndian.PutUint16(buf[n+7:], uint16(count))
+		n = copy(buf[udpFragmentHeaderSize:], part)
+		_, err := c.conn.WriteTo(buf[:udpFragmentHeaderSize+n], addr)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+func (c *fragmentUDPConn) Close() error {
+	return c.conn.Close()
+}
+
+type udpPartialDatagram struct {
+	parts    [][]byte
+	received int
+	size     int
+	created  time.Time
+}
+
+// udpReassembler reassembles fragments into datagrams. Partial datagrams are
+// dropped after timeout or once larger than maxSessionUDPDatagramSize, and the
+// oldest ones are dropped when buffered bytes would exceed maxBytes.
+type udpReassembler struct {
+	timeout  time.Duration
+	maxBytes int
+
+	lock      sync.Mutex
+	partials  map[string]*udpPartialDatagram
+	bytes     int
+	lastPurge time.Time
+}
+
+func newUDPReassembler(timeout time.Duration, maxBytes int) *udpReassembler {
+	return &udpReassembler{
+		timeout:   timeout,
+		maxBytes:  maxBytes,
+		partials:  make(map[string]*udpPartialDatagram),
+		lastPurge: time.Now(),
+	}
+}
+
+// add adds a fragment from addr, and returns the whole datagram if all of its
+// fragments are received.
+func (r *udpReassembler) add(addr string, buf []byte) ([]byte, error) {
+	if len(buf) < udpFragmentHeaderSize || !isUDPFragment(buf) {
+		return nil, ErrInvalidUDPFragment
+	}
+	n := len(udpFragmentMagic)
+	if buf[n] != udpFragmentVersion {
+		return nil, ErrInvalidUDPFragment
+	}
+	id := buf[n+1 : n+5]
+	index := int(binary.BigEndian.Uint16(buf[n+5:]))
+	count := int(binary.BigEndian.Uint16(buf[n+7:]))
+	if count == 0 || index >= count {
+		return nil, ErrInvalidUDPFragment
+	}
+	part := buf[udpFragmentHeaderSize:]
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.lastPurge) > r.timeout/2 {
+		r.purge(now)
+	}
+
+	key := addr + "/" + string(id)
+	p, ok := r.partials[key]
+	if !ok {
+		p = &udpPartialDatagram{parts: make([][]byte, count), created: now}
+		r.partials[key] = p
+	}
+	if len(p.parts) != count {
+		r.remove(key, p)
+		return nil, ErrInvalidUDPFragment
+	}
+	if p.parts[index] != nil {
+		return nil, nil
+	}
+	if p.size+len(part) > maxSessionUDPDatagramSize {
+		r.remove(key, p)
+		return nil, ErrUDPDatagramTooLarge
+	}
+	if r.maxBytes > 0 && r.bytes+len(part) > r.maxBytes {
+		r.evict(key, len(part))
+		if r.bytes+len(part) > r.maxBytes {
+			r.remove(key, p)
+			return nil, errors.New("UDP reassembly buffer is full")
+		}
+	}
+
+	p.parts[index] = append([]byte(nil), part...)
+	p.received++
+	p.size += len(part)
+	r.bytes += len(part)
+
+	if p.received < count {
+		return nil, nil
+	}
+
+	r.remove(key, p)
+	data := make([]byte, 0, p.size)
+	for _, part := range p.parts {
+		data = append(data, part...)
+	}
+	return data, nil
+}
+
+func (r *udpReassembler) remove(key string, p *udpPartialDatagram) {
+	delete(r.partials, key)
+	r.bytes -= p.size
+}
+
+func (r *udpReassembler) purge(now time.Time) {
+	for key, p := range r.partials {
+		if now.Sub(p.created) > r.timeout {
+			r.remove(key, p)
+		}
+	}
+	r.lastPurge = now
+}
+
+// evict drops the oldest partial datagrams other than the one of key until
+// size more bytes can be buffered.
+func (r *udpReassembler) evict(key string, size int) {
+	for r.bytes+size > r.maxBytes {
+		var oldestKey string
+		var oldest *udpPartialDatagram
+		for k, p := range r.partials {
+			if k != key && p.size > 0 && (oldest == nil || p.created.Before(oldest.created)) {
+				oldestKey, oldest = k, p
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		r.remove(oldestKey, oldest)
+	}
+}
@@ -0,0 +1,204 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testUDPConn sends datagrams to peer through a channel.
+type testUDPConn struct {
+	recv   chan []byte
+	peer   *testUDPConn
+	closed int32
+}
+
+func newTestUDPConnPair() (*testUDPConn, *testUDPConn) {
+	a := &testUDPConn{recv: make(chan []byte, 1024)}
+	b := &testUDPConn{recv: make(chan []byte, 1024)}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (c *testUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return copy(b, <-c.recv), &net.UDPAddr{}, nil
+}
+
+func (c *testUDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.peer.recv <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (c *testUDPConn) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return nil
+}
+
+func (c *testUDPConn) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+func udpFragment(id uint32, index, count int, part string) []byte {
+	b := make([]byte, udpFragmentHeaderSize+len(part))
+	n := copy(b, udpFragmentMagic)
+	b[n] = udpFragmentVersion
+	binary.BigEndian.PutUint32(b[n+1:], id)
+	binary.BigEndian.PutUint16(b[n+5:], uint16(index))
+	binary.BigEndian.PutUint16(b[n+7:], uint16(count))
+	copy(b[udpFragmentHeaderSize:], part)
+	return b
+}
+
+func TestFragmentUDPConn(t *testing.T) {
+	a, b := newTestUDPConnPair()
+	sender := newFragmentUDPConn(a, &Config{UDPFragmentSize: 100, UDPReassemblyTimeout: 5000})
+	receiver := newFragmentUDPConn(b, &Config{UDPFragmentSize: 1000, UDPReassemblyTimeout: 5000})
+
+	testCases := []struct {
+		name      string
+		datagram  []byte
+		fragments int
+	}{
+		{"small", []byte("hello"), 0},
+		{"large", bytes.Repeat([]byte("0123456789"), 100), 12},
+		{"starting with magic", []byte(udpFragmentMagic + " is not a fragment"), 1},
+		{"empty", []byte{}, 0},
+	}
+
+	buf := make([]byte, maxSessionUDPDatagramSize)
+	for _, tc := range testCases {
+		_, err := sender.WriteTo(tc.datagram, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		sent := len(b.recv)
+		if tc.fragments == 0 {
+			if sent != 1 || !bytes.Equal(<-b.recv, tc.datagram) {
+				t.Fatalf("%s: datagram is not sent as is", tc.name)
+			}
+			sender.WriteTo(tc.datagram, nil)
+		} else if sent != tc.fragments {
+			t.Fatalf("%s: sent %d fragments, expected %d", tc.name, sent, tc.fragments)
+		}
+
+		n, _, err := receiver.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !bytes.Equal(buf[:n], tc.datagram) {
+			t.Fatalf("%s: received %q, expected %q", tc.name, buf[:n], tc.datagram)
+		}
+	}
+}
+
+func TestFragmentUDPDisabled(t *testing.T) {
+	a, _ := newTestUDPConnPair()
+	if conn := fragmentUDP(a, &Config{UDPReassemblyTimeout: 5000}); conn != a {
+		t.Fatal("datagrams are not passed through without fragment size")
+	}
+}
+
+func TestFragmentUDPConnTooLarge(t *testing.T) {
+	a, b := newTestUDPConnPair()
+	receiver := newFragmentUDPConn(b, &Config{UDPFragmentSize: 100, UDPReassemblyTimeout: 5000})
+	a.WriteTo(udpFragment(1, 0, 2, "0123456789"), nil)
+	a.WriteTo(udpFragment(1, 1, 2, "0123456789"), nil)
+	a.WriteTo([]byte("small"), nil)
+
+	buf := make([]byte, 10)
+	n, _, err := receiver.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "small" {
+		t.Fatalf("got %q, %v, expected datagram after the too large one", buf[:n], err)
+	}
+}
+
+func TestUDPReassembler(t *testing.T) {
+	t.Run("out of order and duplicate", func(t *testing.T) {
+		r := newUDPReassembler(time.Minute, 0)
+		for _, f := range [][]byte{udpFragment(1, 2, 3, "c"), udpFragment(1, 0, 3, "a"), udpFragment(1, 0, 3, "x")} {
+			data, err := r.add("addr", f)
+			if err != nil || data != nil {
+				t.Fatalf("got %q, %v before all fragments are received", data, err)
+			}
+		}
+		data, err := r.add("addr", udpFragment(1, 1, 3, "b"))
+		if err != nil || string(data) != "abc" {
+			t.Fatalf("got %q, %v, expected %q", data, err, "abc")
+		}
+		if len(r.partials) != 0 || r.bytes != 0 {
+			t.Fatalf("%d partials and %d bytes left", len(r.partials), r.bytes)
+		}
+	})
+
+	t.Run("separate addresses", func(t *testing.T) {
+		r := newUDPReassembler(time.Minute, 0)
+		r.add("a", udpFragment(1, 0, 2, "a"))
+		data, _ := r.add("b", udpFragment(1, 1, 2, "b"))
+		if data != nil || len(r.partials) != 2 {
+			t.Fatalf("fragments of different addresses are mixed")
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		r := newUDPReassembler(10*time.Millisecond, 0)
+		r.add("addr", udpFragment(1, 0, 2, "a"))
+		time.Sleep(20 * time.Millisecond)
+		data, err := r.add("addr", udpFragment(1, 1, 2, "b"))
+		if err != nil || data != nil {
+			t.Fatalf("got %q, %v from expired fragment", data, err)
+		}
+		if len(r.partials) != 1 || r.bytes != 1 {
+			t.Fatalf("%d partials and %d bytes left, expected 1 and 1", len(r.partials), r.bytes)
+		}
+	})
+
+	t.Run("max bytes eviction", func(t *testing.T) {
+		r := newUDPReassembler(time.Minute, 4)
+		r.add("addr", udpFragment(1, 0, 2, "aa"))
+		time.Sleep(time.Millisecond)
+		r.add("addr", udpFragment(2, 0, 2, "bb"))
+		data, err := r.add("addr", udpFragment(3, 0, 2, "cc"))
+		if err != nil || data != nil {
+			t.Fatalf("got %q, %v", data, err)
+		}
+		if _, ok := r.partials["addr/"+string([]byte{0, 0, 0, 1})]; ok {
+			t.Fatal("oldest partial datagram is not evicted")
+		}
+		if len(r.partials) != 2 || r.bytes != 4 {
+			t.Fatalf("%d partials and %d bytes left, expected 2 and 4", len(r.partials), r.bytes)
+		}
+
+		_, err = r.add("addr", udpFragment(4, 0, 2, "ddddd"))
+		if err == nil {
+			t.Fatal("fragment larger than max bytes is buffered")
+		}
+		if r.bytes > 4 {
+			t.Fatalf("%d bytes buffered, more than max bytes", r.bytes)
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		r := newUDPReassembler(time.Minute, 0)
+		part := string(bytes.Repeat([]byte("a"), maxSessionUDPDatagramSize/2+1))
+		r.add("addr", udpFragment(1, 0, 3, part))
+		_, err := r.add("addr", udpFragment(1, 1, 3, part))
+		if err != ErrUDPDatagramTooLarge {
+			t.Fatalf("got %v, expected %v", err, ErrUDPDatagramTooLarge)
+		}
+		if len(r.partials) != 0 || r.bytes != 0 {
+			t.Fatalf("%d partials and %d bytes left", len(r.partials), r.bytes)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		r := newUDPReassembler(time.Minute, 0)
+		for _, f := range [][]byte{udpFragment(1, 2, 2, "a"), udpFragment(1, 0, 0, "a"), []byte(udpFragmentMagic)} {
+			if _, err := r.add("addr", f); err == nil {
+				t.Fatalf("invalid fragment %q is accepted", f)
+			}
+		}
+	})
+}
@@ -0,0 +1,308 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/nknorg/ncp-go"
+	"github.com/nknorg/nkn-sdk-go"
+)
+
+// UDP datagrams can be carried inside a reliable session, each datagram is
+// prefixed by its length in 2 bytes big endian.
+const (
+	maxSessionUDPDatagramSize = 65535
+	sessionUDPRecvQueueSize   = 1024
+)
+
+var (
+	ErrUDPDatagramTooLarge = errors.New("UDP datagram is too large")
+)
+
+type sessionDialer interface {
+	DialWithConfig(addr string, config *nkn.DialConfig) (*ncp.Session, error)
+}
+
+// dialSessionUDP dials a session to remoteAddr and uses it to carry UDP
+// datagrams.
+func dialSessionUDP(dialer sessionDialer, remoteAddr string, config *nkn.DialConfig, port int) (*sessionUDPConn, error) {
+	sess, err := dialer.DialWithConfig(remoteAddr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = dialHandshake(sess, &handshakeRequest{Type: handshakeTypeUDP, Port: port})
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+
+	return newSessionUDPConn(sess), nil
+}
+
+// sessionUDPConn carries UDP datagrams to and from a single session.
+type sessionUDPConn struct {
+	conn      net.Conn
+	writeLock sync.Mutex
+}
+
+func newSessionUDPConn(conn net.Conn) *sessionUDPConn {
+	return &sessionUDPConn{conn: conn}
+}
+
+func (c *sessionUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := readDatagram(c.conn, b)
+	return n, c.conn.RemoteAddr(), err
+}
+
+func (c *sessionUDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return writeDatagram(c.conn, b)
+}
+
+func (c *sessionUDPConn) Close() error {
+	return c.conn.Close()
+}
+
+func readDatagram(r io.Reader, b []byte) (int, error) {
+	var header [2]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return 0, err
+	}
+
+	size := int(binary.BigEndian.Uint16(header[:]))
+	if size > len(b) {
+		_, err = io.CopyN(io.Discard, r, int64(size))
+		if err != nil {
+			return 0, err
+		}
+		return 0, ErrUDPDatagramTooLarge
+	}
+
+	return io.ReadFull(r, b[:size])
+}
+
+func writeDatagram(w io.Writer, b []byte) (int, error) {
+	if len(b) > maxSessionUDPDatagramSize {
+		return 0, ErrUDPDatagramTooLarge
+	}
+
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+
+	_, err := w.Write(buf)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// sessionUDPAddr identifies a UDP session, as one remote address may have
+// multiple UDP sessions. Port is the remote port requested by the session.
+type sessionUDPAddr struct {
+	remoteAddr net.Addr
+	id         uint64
+	port       int
+}
+
+func (a *sessionUDPAddr) Network() string {
+	return "nkn-udp"
+}
+
+func (a *sessionUDPAddr) String() string {
+	return fmt.Sprintf("%s#%d", a.remoteAddr, a.id)
+}
+
+type udpDatagram struct {
+	data []byte
+	addr net.Addr
+}
+
+// sessionUDPListener receives UDP datagrams from all accepted UDP sessions,
+// and sends UDP datagrams to the session identified by address. The address
+// of a session is passed to onSessionClose once the session is closed.
+type sessionUDPListener struct {
+	recv           chan *udpDatagram
+	closed         chan struct{}
+	lock           sync.Mutex
+	nextID         uint64
+	conns          map[string]*sessionUDPConn
+	onClose        sync.Once
+	onSessionClose func(addr net.Addr)
+}
+
+func newSessionUDPListener(onSessionClose func(addr net.Addr)) *sessionUDPListener {
+	return &sessionUDPListener{
+		recv:           make(chan *udpDatagram, sessionUDPRecvQueueSize),
+		closed:         make(chan struct{}),
+		conns:          make(map[string]*sessionUDPConn),
+		onSessionClose: onSessionClose,
+	}
+}
+
+// addSession starts receiving UDP datagrams from an accepted session.
+func (l *sessionUDPListener) addSession(conn net.Conn, port int) {
+	l.lock.Lock()
+	l.nextID++
+	addr := &sessionUDPAddr{remoteAddr: conn.RemoteAddr(), id: l.nextID, port: port}
+	c := newSessionUDPConn(conn)
+	l.conns[addr.String()] = c
+	l.lock.Unlock()
+
+	go func() {
+		defer func() {
+			l.lock.Lock()
+			delete(l.conns, addr.String())
+			l.lock.Unlock()
+			c.Close()
+			if l.onSessionClose != nil {
+				l.onSessionClose(addr)
+			}
+		}()
+
+		b := make([]byte, maxSessionUDPDatagramSize)
+		for {
+			n, _, err := c.ReadFrom(b)
+			if err != nil {
+				if errors.Is(err, ErrUDPDatagramTooLarge) {
+					continue
+				}
+				return
+			}
+
+			data := make([]byte, n)
+			copy(data, b[:n])
+			select {
+			case l.recv <- &udpDatagram{data: data, addr: addr}:
+			case <-l.closed:
+				return
+			default:
+				log.Println("UDP session receive queue full, discard datagram")
+			}
+		}
+	}()
+}
+
+func (l *sessionUDPListener) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case d := <-l.recv:
+		return copy(b, d.data), d.addr, nil
+	case <-l.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (l *sessionUDPListener) WriteTo(b []byte, addr net.Addr) (int, error) {
+	l.lock.Lock()
+	c, ok := l.conns[addr.String()]
+	l.lock.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("UDP session %s not found", addr)
+	}
+	return c.WriteTo(b, addr)
+}
+
+func (l *sessionUDPListener) Close() error {
+	l.onClose.Do(func() {
+		close(l.closed)
+		l.lock.Lock()
+		for _, c := range l.conns {
+			c.Close()
+		}
+		l.lock.Unlock()
+	})
+	return nil
+}
+
+// handleUDPSession hands an accepted UDP session to the UDP session listener.
+func (t *Tunnel) handleUDPSession(conn net.Conn, req *handshakeRequest) {
+	if t.udpSessionListener == nil {
+		replyHandshake(conn, nil, ErrUDPNotSupported)
+		conn.Close()
+		return
+	}
+
+	err := replyHandshake(conn, nil, nil)
+	if err != nil {
+		log.Println(err)
+		conn.Close()
+		return
+	}
+
+	t.udpSessionListener.addSession(conn, req.Port)
+}
+
+// mergedUDPConn receives UDP datagrams from both a UDP conn and a UDP session
+// listener, and sends UDP datagrams to the one the address belongs to.
+type mergedUDPConn struct {
+	conn     udpConn
+	sessions *sessionUDPListener
+	recv     chan *udpDatagram
+	closed   chan struct{}
+	onClose  sync.Once
+}
+
+func newMergedUDPConn(conn udpConn, sessions *sessionUDPListener) *mergedUDPConn {
+	m := &mergedUDPConn{
+		conn:     conn,
+		sessions: sessions,
+		recv:     make(chan *udpDatagram, sessionUDPRecvQueueSize),
+		closed:   make(chan struct{}),
+	}
+	go m.readLoop(conn)
+	go m.readLoop(sessions)
+	return m
+}
+
+func (m *mergedUDPConn) readLoop(conn udpConn) {
+	defer m.Close()
+	b := make([]byte, maxSessionUDPDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+
+		data := make([]byte, n)
+		copy(data, b[:n])
+		select {
+		case m.recv <- &udpDatagram{data: data, addr: addr}:
+		case <-m.closed:
+			return
+		}
+	}
+}
+
+func (m *mergedUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case d := <-m.recv:
+		return copy(b, d.data), d.addr, nil
+	case <-m.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (m *mergedUDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if _, ok := addr.(*sessionUDPAddr); ok {
+		return m.sessions.WriteTo(b, addr)
+	}
+	return m.conn.WriteTo(b, addr)
+}
+
+func (m *mergedUDPConn) Close() error {
+	var err error
+	m.onClose.Do(func() {
+		close(m.closed)
+		m.sessions.Close()
+		err = m.conn.Close()
+	})
+	return err
+}